@@ -0,0 +1,273 @@
+package flamel
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// An Encoder compresses responses with a content coding
+type Encoder struct {
+	// the content coding, as listed in Accept-Encoding, i.e. "gzip"
+	Coding string
+	// returns a writer compressing to w. The response is complete when the writer is closed
+	NewWriter func(w io.Writer) io.WriteCloser
+}
+
+// Compression configures the compression of the responses, negotiated through the Accept-Encoding header
+type Compression struct {
+	// the supported encoders, in order of preference when the client accepts more than one with the same quality
+	Encoders []Encoder
+	// responses smaller than MinSize bytes are sent uncompressed
+	MinSize int
+	// the media types that are compressed. A type ending with "/" matches every subtype, i.e. "text/"
+	ContentTypes []string
+}
+
+// Returns a compression configuration with gzip and deflate encoders, compressing textual responses of at least 1KB
+func DefaultCompression() *Compression {
+	return &Compression{
+		Encoders: []Encoder{GzipEncoder, DeflateEncoder},
+		MinSize:  1024,
+		ContentTypes: []string{
+			"text/",
+			"application/json",
+			"application/problem+json",
+			"application/x-ndjson",
+			"application/javascript",
+			"application/xml",
+			"image/svg+xml",
+		},
+	}
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// returns the gzip writer to the pool once closed
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	gzipPool.Put(w.Writer)
+	return err
+}
+
+var GzipEncoder = Encoder{
+	Coding: "gzip",
+	NewWriter: func(w io.Writer) io.WriteCloser {
+		gz := gzipPool.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return pooledGzipWriter{gz}
+	},
+}
+
+var zlibPool = sync.Pool{
+	New: func() interface{} {
+		return zlib.NewWriter(nil)
+	},
+}
+
+// returns the zlib writer to the pool once closed
+type pooledZlibWriter struct {
+	*zlib.Writer
+}
+
+func (w pooledZlibWriter) Close() error {
+	err := w.Writer.Close()
+	zlibPool.Put(w.Writer)
+	return err
+}
+
+// The deflate content coding is the zlib format (RFC 9110), not raw DEFLATE
+var DeflateEncoder = Encoder{
+	Coding: "deflate",
+	NewWriter: func(w io.Writer) io.WriteCloser {
+		zw := zlibPool.Get().(*zlib.Writer)
+		zw.Reset(w)
+		return pooledZlibWriter{zw}
+	},
+}
+
+// Returns the encoder preferred by the client, or nil if the client accepts none of the supported ones
+func (c *Compression) negotiate(req *http.Request) *Encoder {
+	accept, ok := req.Header["Accept-Encoding"]
+	if !ok {
+		return nil
+	}
+
+	specs := parseAcceptFormat(accept)
+	var best *Encoder
+	maxQ := 0.0
+	for i := range c.Encoders {
+		encoder := &c.Encoders[i]
+		q := -1.0
+		for _, spec := range specs {
+			switch {
+			case strings.EqualFold(spec.Value, encoder.Coding):
+				q = spec.Quality
+			case spec.Value == "*" && q < 0:
+				q = spec.Quality
+			}
+		}
+		if q > maxQ {
+			maxQ = q
+			best = encoder
+		}
+	}
+	return best
+}
+
+// reports whether responses with the content type should be compressed
+func (c *Compression) compressible(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return false
+	}
+
+	for _, t := range c.ContentTypes {
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether the output of the renderer can be compressed.
+// Blobs and files are usually compressed already and can be requested by range,
+// while events and websockets must reach the client as they are written
+func compressibleRenderer(renderer Renderer) bool {
+	switch renderer.(type) {
+	case *BlobRenderer, *DownloadRenderer, *FileRenderer, *SSERenderer, *webSocketRenderer:
+		return false
+	}
+	return true
+}
+
+// A compressWriter buffers the beginning of the response until MinSize bytes are written,
+// then decides whether to compress it, depending on its status and content type
+type compressWriter struct {
+	http.ResponseWriter
+	compression *Compression
+	encoder     *Encoder
+	status      int
+	buf         []byte
+	decided     bool
+	enc         io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.compression.MinSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// sets the encoding of the response and sends the buffered output
+func (w *compressWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if _, ok := h["Content-Type"]; !ok && len(w.buf) > 0 {
+		// detect the type as net/http would, before the body is compressed
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	eligible := h.Get("Content-Encoding") == "" && status != http.StatusPartialContent &&
+		!bodylessStatus(status) && w.compression.compressible(h.Get("Content-Type"))
+
+	if eligible && w.encoder != nil && len(w.buf) >= w.compression.MinSize {
+		h.Set("Content-Encoding", w.encoder.Coding)
+		h.Del("Content-Length")
+		// the compressed representation is not byte for byte equal to the uncompressed one
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.enc = w.encoder.NewWriter(w.ResponseWriter)
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sends what is left of the output and terminates the compressed stream
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+// wraps the writer in a compressWriter, if the instance compresses the responses and the renderer output can be compressed.
+// The response varies on Accept-Encoding from then on, so that caches don't serve a 304 for a representation
+// in the wrong coding
+func (fl *flamel) compressWriter(w http.ResponseWriter, req *http.Request, renderer Renderer) *compressWriter {
+	c := fl.Config.Compression
+	if c == nil || !compressibleRenderer(renderer) {
+		return nil
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, compression: c, encoder: c.negotiate(req)}
+}
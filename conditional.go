@@ -0,0 +1,179 @@
+package flamel
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// returns a weak entity tag computed from the content
+func weakETag(content []byte) string {
+	h := fnv.New64a()
+	h.Write(content)
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// quotes the entity tag, unless it is already a quoted, strong or weak, entity tag
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// splits the list of entity tags of an If-Match or If-None-Match header
+func parseETags(header string) []string {
+	var etags []string
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			return etags
+		}
+
+		if header[0] == '*' {
+			etags = append(etags, "*")
+			header = header[1:]
+			continue
+		}
+
+		start := 0
+		if strings.HasPrefix(header, "W/") {
+			start = 2
+		}
+		if len(header) <= start || header[start] != '"' {
+			// malformed list, ignore the rest of it
+			return etags
+		}
+		end := strings.IndexByte(header[start+1:], '"')
+		if end == -1 {
+			return etags
+		}
+		end += start + 2
+		etags = append(etags, header[:end])
+		header = header[end:]
+	}
+}
+
+// compares two entity tags. The weak comparison ignores the weakness indicator,
+// while the strong comparison requires both tags to be strong
+func matchETag(a string, b string, weak bool) bool {
+	aWeak, bWeak := strings.HasPrefix(a, "W/"), strings.HasPrefix(b, "W/")
+	if !weak && (aWeak || bWeak) {
+		return false
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// reports whether any of the tags of the header matches the entity tag. "*" matches any existing representation
+func matchAnyETag(header string, etag string, exists bool, weak bool) bool {
+	for _, candidate := range parseETags(header) {
+		if (candidate == "*" && exists) || (etag != "" && matchETag(candidate, etag, weak)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether the resource has been modified after the date of the header.
+// Dates are compared with the precision of the http date format, seconds
+func modifiedSince(header string, lastModified time.Time) (bool, bool) {
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return false, false
+	}
+	return lastModified.Truncate(time.Second).After(date), true
+}
+
+// Evaluates the preconditions of the request against the validators of the selected representation, as per RFC 7232.
+// exists is false if the target resource has no current representation.
+// Returns the status the response should have if a precondition fails,
+// 304 Not Modified for GET and HEAD requests and 412 Precondition Failed otherwise, or 0 if the request can proceed
+func evaluatePreconditions(req *http.Request, etag string, lastModified time.Time, exists bool) int {
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !matchAnyETag(ifMatch, etag, exists, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since := req.Header.Get("If-Unmodified-Since"); since != "" && !lastModified.IsZero() {
+		if modified, ok := modifiedSince(since, lastModified); ok && modified {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	safe := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchAnyETag(ifNoneMatch, etag, exists, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since := req.Header.Get("If-Modified-Since"); safe && since != "" && !lastModified.IsZero() {
+		if modified, ok := modifiedSince(since, lastModified); ok && !modified {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// Sets the strong entity tag of the response. The tag is quoted if it isn't already
+func (out *ResponseOutput) SetETag(etag string) {
+	out.etag = quoteETag(etag)
+}
+
+// Sets the modification date of the response
+func (out *ResponseOutput) SetLastModified(t time.Time) {
+	out.lastModified = t
+}
+
+// Evaluates the preconditions of the request against the entity tag and the modification date set on the output.
+// The resource is considered to exist if any of them is set, so that "If-None-Match: *" prevents overwriting it.
+// Controllers of unsafe methods, i.e. PUT or PATCH, call it before modifying the resource, so that lost updates are avoided:
+//
+//	out.SetETag(product.Version)
+//	if response, failed := out.CheckPreconditions(ctx); failed {
+//		return response
+//	}
+//
+// If a precondition fails it returns the response to send, 412 Precondition Failed or 304 Not Modified, and true
+func (out *ResponseOutput) CheckPreconditions(ctx context.Context) (HttpResponse, bool) {
+	req, ok := ctx.Value(keyRequest).(*http.Request)
+	if !ok {
+		return HttpResponse{}, false
+	}
+
+	if status := evaluatePreconditions(req, out.etag, out.lastModified, out.etag != "" || !out.lastModified.IsZero()); status != 0 {
+		out.Renderer = &TextRenderer{}
+		return HttpResponse{Status: status}, true
+	}
+	return HttpResponse{}, false
+}
+
+// Sets the validators of the output on the response and evaluates the preconditions of GET and HEAD requests.
+// If the instance computes entity tags automatically, the tag is computed from buf, the buffered output of the renderer.
+// Returns the status of the failed precondition, or 0
+func (fl *flamel) conditional(w http.ResponseWriter, req *http.Request, out *ResponseOutput, response HttpResponse, buf *bufferedWriter) int {
+	if response.Status != 0 && response.Status != http.StatusOK {
+		return 0
+	}
+
+	safe := req.Method == http.MethodGet || req.Method == http.MethodHead
+	etag := out.etag
+	if etag == "" && fl.Config.AutoETag && safe && buf != nil {
+		etag = weakETag(buf.buf.Bytes())
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !out.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", out.lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if !safe {
+		return 0
+	}
+	return evaluatePreconditions(req, etag, out.lastModified, true)
+}
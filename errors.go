@@ -0,0 +1,109 @@
+package flamel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+)
+
+// An ErrorHandler renders the response of a request that can't be served because of err.
+// It is invoked with the request context and a fresh output, as a controller would be.
+type ErrorHandler func(ctx context.Context, err error, out *ResponseOutput) HttpResponse
+
+// returns an ErrorHandler that renders the text of the given status, without leaking the error to the client
+func statusTextHandler(status int) ErrorHandler {
+	return func(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+		out.Renderer = &TextRenderer{Data: http.StatusText(status)}
+		return HttpResponse{Status: status}
+	}
+}
+
+// Responds 404 Not Found
+func DefaultNotFoundHandler(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+	return statusTextHandler(http.StatusNotFound)(ctx, err, out)
+}
+
+// Responds 405 Method Not Allowed. The Allow header is set by flamel before the handler is invoked
+func DefaultMethodNotAllowedHandler(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+	return statusTextHandler(http.StatusMethodNotAllowed)(ctx, err, out)
+}
+
+// Responds 500 Internal Server Error
+func DefaultErrorHandler(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+	return statusTextHandler(http.StatusInternalServerError)(ctx, err, out)
+}
+
+// renders the response of the error handler
+func (fl *flamel) handleError(ctx context.Context, w http.ResponseWriter, req *http.Request, handler ErrorHandler, err error) {
+	out := newResponseOutput()
+	response := handler(ctx, err, &out)
+	if err := fl.write(ctx, w, req, &out, response); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// A PanicError is the error handled by the PanicHandler when a request panics
+type PanicError struct {
+	// the value the request panicked with
+	Value interface{}
+	// the stack trace of the goroutine at the moment of the panic
+	Stack []byte
+	// the status the response should have:
+	// 400 Bad Request if the panic has been caused by a bad input, i.e. by RequestInputs.MustInt, 500 otherwise
+	Status int
+}
+
+func newPanicError(value interface{}) *PanicError {
+	p := &PanicError{Value: value, Stack: debug.Stack(), Status: http.StatusInternalServerError}
+	switch value.(type) {
+	case MissingInputError, *strconv.NumError:
+		p.Status = http.StatusBadRequest
+	}
+	return p
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Returns the value of the panic if it is an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Responds with the status of the PanicError. Panics that are not caused by bad inputs are logged along with their stack trace
+func DefaultPanicHandler(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+	status := http.StatusInternalServerError
+	if p, ok := err.(*PanicError); ok {
+		status = p.Status
+		if status >= http.StatusInternalServerError {
+			log.Printf("%s\n%s", p, p.Stack)
+		}
+	}
+	return statusTextHandler(status)(ctx, err, out)
+}
+
+// renders the response of a request that panicked with the given value
+func (fl *flamel) handlePanic(ctx context.Context, w http.ResponseWriter, req *http.Request, value interface{}) {
+	// let the server abort the response
+	if value == http.ErrAbortHandler {
+		panic(value)
+	}
+
+	fl.handleError(ctx, w, req, fl.Config.PanicHandler, newPanicError(value))
+}
+
+// logs the panic of a request whose response has already been partially sent, then aborts the response,
+// since an error response can't be written on top of it
+func abortResponse(req *http.Request, value interface{}) {
+	if value != http.ErrAbortHandler {
+		log.Printf("panic serving %s after the response was sent: %v\n%s", req.URL.Path, value, debug.Stack())
+	}
+	panic(http.ErrAbortHandler)
+}
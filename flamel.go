@@ -1,13 +1,11 @@
 package flamel
 
 import (
-	"bytes"
 	"context"
 	"decodica.com/flamel/cors"
-	"decodica.com/flamel/internal/router"
 	"fmt"
-	"google.golang.org/appengine"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
 	"sync"
@@ -16,9 +14,11 @@ import (
 type flamel struct {
 	Config
 	app            Application
-	bufferPool     *sync.Pool
 	services       []Service
+	middlewares    []Middleware
 	contentOfferer ContentOfferer
+	// guards the initialization of the services
+	initialize sync.Once
 }
 
 type Application interface {
@@ -38,6 +38,25 @@ type Config struct {
 	EnforceHostnameRedirect string
 	MaxFileUploadSize       int64
 	ContentOfferer          ContentOfferer
+	// the environment flamel runs in. Defaults to Google App Engine
+	Runtime Runtime
+	// how non canonical paths, i.e. with a mismatching trailing slash or dot segments, are handled. Defaults to PathStrict
+	PathPolicy PathPolicy
+	// renders the response when no route matches the request path
+	NotFoundHandler ErrorHandler
+	// renders the response when the route matching the path doesn't handle the request method
+	MethodNotAllowedHandler ErrorHandler
+	// renders the response when the request can't be served because of an internal error
+	ErrorHandler ErrorHandler
+	// renders the response when the request panics. The error is a *PanicError
+	PanicHandler ErrorHandler
+	// computes a weak ETag for the output of buffered renderers (templates, JSON and text) of GET and HEAD requests,
+	// unless the controller sets one, so that unchanged pages are answered with 304 Not Modified
+	AutoETag bool
+	// compresses the responses with the encoding accepted by the client. No response is compressed if nil
+	Compression *Compression
+	// the templates of the application, available to controllers through TemplatesFromContext
+	Templates *Templates
 	Router
 }
 
@@ -47,6 +66,11 @@ func DefaultConfig() Config {
 	// default max size of upload is 4 megs
 	config.MaxFileUploadSize = (1 << 20) * 4
 	config.ContentOfferer = defaultContentOfferer{}
+	config.Runtime = AppengineRuntime{}
+	config.NotFoundHandler = DefaultNotFoundHandler
+	config.MethodNotAllowedHandler = DefaultMethodNotAllowedHandler
+	config.ErrorHandler = DefaultErrorHandler
+	config.PanicHandler = DefaultPanicHandler
 	return config
 }
 
@@ -70,27 +94,68 @@ var once sync.Once
 func Instance() *flamel {
 
 	once.Do(func() {
-		config := DefaultConfig()
-
-		pool := sync.Pool{
-			New: func() interface{} {
-				return bytes.Buffer{}
-			},
-		}
-		instance = &flamel{Config: config, bufferPool: &pool, contentOfferer: config.ContentOfferer}
+		instance = newFlamel(DefaultConfig())
 	})
 
 	return instance
 }
 
-func (fl *flamel) Run(application Application) {
+// Creates a new, independent, flamel instance serving the given application.
+// The returned instance is an http.Handler: it can be mounted on any mux, under any prefix,
+// and several instances can live in the same process without sharing any state.
+// Services added to the instance are initialized as soon as the first request is served.
+func New(config Config, application Application) *flamel {
+	fl := newFlamel(config)
 	fl.launchApp(application)
-	defer fl.end()
-	http.HandleFunc("/", fl.run)
-	appengine.Main()
+	return fl
 }
 
-func (fl *flamel) end() {
+func newFlamel(config Config) *flamel {
+	defaults := DefaultConfig()
+	if config.Router == nil {
+		config.Router = defaults.Router
+	}
+	if config.ContentOfferer == nil {
+		config.ContentOfferer = defaults.ContentOfferer
+	}
+	if config.Runtime == nil {
+		config.Runtime = defaults.Runtime
+	}
+	if config.NotFoundHandler == nil {
+		config.NotFoundHandler = defaults.NotFoundHandler
+	}
+	if config.MethodNotAllowedHandler == nil {
+		config.MethodNotAllowedHandler = defaults.MethodNotAllowedHandler
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = defaults.ErrorHandler
+	}
+	if config.PanicHandler == nil {
+		config.PanicHandler = defaults.PanicHandler
+	}
+	return &flamel{Config: config, contentOfferer: config.ContentOfferer}
+}
+
+func (fl *flamel) Run(application Application) error {
+	fl.launchApp(application)
+	if fl.Config.Templates != nil {
+		if err := fl.Config.Templates.Load(); err != nil {
+			return err
+		}
+	}
+	fl.initialize.Do(fl.initServices)
+	defer fl.Close()
+	return fl.Runtime.Serve(fl)
+}
+
+func (fl *flamel) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fl.initialize.Do(fl.initServices)
+	fl.run(w, req)
+}
+
+// Destroys the services of the instance.
+// Instances created with New must be closed by the client code once they stop serving requests
+func (fl *flamel) Close() {
 	for _, s := range fl.services {
 		s.Destroy()
 	}
@@ -101,8 +166,9 @@ func (fl *flamel) launchApp(application Application) {
 		panic("Application already set")
 	}
 	fl.app = application
+}
 
-	// initialize services
+func (fl *flamel) initServices() {
 	for _, s := range fl.services {
 		s.Initialize()
 	}
@@ -114,7 +180,19 @@ func (fl *flamel) run(w http.ResponseWriter, req *http.Request) {
 		panic("must set Flamel's application!")
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := fl.Runtime.NewContext(req)
+	ctx = context.WithValue(ctx, keyRouter, fl.Router)
+	ctx = context.WithValue(ctx, keyRequest, req)
+	if fl.Config.Templates != nil {
+		ctx = context.WithValue(ctx, keyTemplates, fl.Config.Templates)
+	}
+
+	// recover from panics happening outside of the controller, i.e. in the authenticators
+	defer func() {
+		if r := recover(); r != nil {
+			fl.handlePanic(ctx, w, req, r)
+		}
+	}()
 
 	ctx = fl.app.OnStart(ctx)
 	for _, s := range fl.services {
@@ -141,6 +219,19 @@ func (fl *flamel) run(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	path := req.URL.Path
+	if fl.Config.PathPolicy != PathStrict {
+		if canonical, changed := fl.canonicalPath(path); changed {
+			if fl.Config.PathPolicy == PathRedirect {
+				redirectToPath(w, req, canonical)
+				renderer := TextRenderer{}
+				renderer.Render(w)
+				return
+			}
+			path = canonical
+		}
+	}
+
 	origin := req.Header.Get("Origin")
 	hasOrigin := origin != ""
 
@@ -155,45 +246,44 @@ func (fl *flamel) run(w http.ResponseWriter, req *http.Request) {
 
 	//add inputs to the context object
 	ins, err := fl.parseRequestInputs(ctx, req)
+	if err != nil {
+		// keep the url available to the error handler
+		ins = RequestInputs{KeyRequestURL: requestInput{values: []string{req.URL.Path}}}
+	}
+
+	// negotiate the content with the default offerer, in case the request can't be routed
+	ins[KeyNegotiatedContent] = requestInput{values: []string{fl.negotiatedContent(req, fl.contentOfferer)}}
 	ctx = context.WithValue(ctx, KeyRequestInputs, ins)
 	if err != nil {
-		renderer := TextRenderer{}
-		renderer.Data = err.Error()
-		w.WriteHeader(http.StatusInternalServerError)
-		renderer.Render(w)
+		fl.handleError(ctx, w, req, fl.Config.ErrorHandler, err)
 		return
 	}
 
-	ctx, err, controller := fl.RouteForPath(ctx, req.URL.Path)
+	ctx, err, controller := fl.RouteForPath(ctx, req.Method, path)
 
-	if err == router.ErrRouteNotFound {
-		renderer := TextRenderer{}
-		renderer.Data = err.Error()
-		w.WriteHeader(http.StatusNotFound)
-		renderer.Render(w)
+	if err == ErrRouteNotFound {
+		fl.handleError(ctx, w, req, fl.Config.NotFoundHandler, err)
+		return
+	}
+
+	if e, ok := err.(MethodNotAllowedError); ok {
+		w.Header().Set("Allow", strings.Join(e.Allowed, ", "))
+		fl.handleError(ctx, w, req, fl.Config.MethodNotAllowedHandler, err)
 		return
 	}
 
 	if err != nil {
-		renderer := TextRenderer{}
-		renderer.Data = err.Error()
-		w.WriteHeader(http.StatusInternalServerError)
-		renderer.Render(w)
+		fl.handleError(ctx, w, req, fl.Config.ErrorHandler, err)
 		return
 	}
 
 	defer fl.destroy(ctx, controller)
 
 	// negotiated content
-	cnt := requestInput{}
 	if offerer, ok := controller.(ContentOfferer); ok {
-		cnt.values = []string{fl.negotiatedContent(req, offerer)}
-	} else {
-		cnt.values = []string{fl.negotiatedContent(req, fl.contentOfferer)}
+		ins[KeyNegotiatedContent] = requestInput{values: []string{fl.negotiatedContent(req, offerer)}}
 	}
 
-	ins[KeyNegotiatedContent] = cnt
-
 	out := newResponseOutput()
 
 	//handle the CORS framework
@@ -231,33 +321,117 @@ func (fl *flamel) run(w http.ResponseWriter, req *http.Request) {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			}
+			ctx = context.WithValue(ctx, keyAllowedOrigin, origin)
 		}
 	}
 
-	response := controller.Process(ctx, &out)
+	response := fl.process(ctx, controller, &out)
 
-	//add headers and cookies
-	for _, v := range out.cookies {
-		http.SetCookie(w, v)
+	err = fl.write(ctx, w, req, &out, response)
+	if err != nil {
+		fl.handleError(ctx, w, req, fl.Config.ErrorHandler, err)
+		return
 	}
+}
 
-	for k, v := range out.headers {
-		w.Header().Set(k, v)
+// writes the output to the client
+func (fl *flamel) write(ctx context.Context, w http.ResponseWriter, req *http.Request, out *ResponseOutput, response HttpResponse) error {
+	if response.Status >= 300 && response.Status < 400 && response.Location != "" {
+		out.writeHeader(w)
+		http.Redirect(w, req, response.Location, response.Status)
+		return nil
 	}
 
-	if response.Status >= 300 && response.Status < 400 {
-		http.Redirect(w, req, response.Location, response.Status)
+	// the renderer of the negotiated content replaces the negotiated renderer, so that it is buffered and compressed as its own type
+	if negotiated, ok := out.Renderer.(*NegotiatedRenderer); ok {
+		// the response depends on the Accept header, whatever renderer is chosen, 406 Not Acceptable included
+		out.AppendHeader("Vary", "Accept")
+		out.Renderer = negotiated.renderer(ctx)
 	}
 
-	if response.Status >= 400 {
-		w.WriteHeader(response.Status)
+	// buffered renderers are rendered before anything is sent, so that a failure doesn't leave a truncated response
+	var buf *bufferedWriter
+	if isBuffered(out.Renderer) {
+		buf = getBufferedWriter()
+		defer putBufferedWriter(buf)
+		if err := render(ctx, out.Renderer, buf); err != nil {
+			return err
+		}
+	}
+
+	// the headers of the response are restored if an unbuffered renderer fails before sending anything,
+	// so that the error response doesn't inherit them, i.e. a Content-Disposition or a Cache-Control
+	var snapshot http.Header
+	if buf == nil {
+		snapshot = w.Header().Clone()
+	}
+
+	out.writeHeader(w)
+	if buf != nil {
+		buf.copyHeader(w.Header())
+	}
+
+	rw := newResponseWriter(w, req, response.Status)
+	// once the status has been sent, a panicking renderer can't be answered with an error response
+	defer func() {
+		if rw.wroteHeader {
+			if r := recover(); r != nil {
+				abortResponse(req, r)
+			}
+		}
+	}()
+
+	// compression is set before the preconditions are evaluated, so that a 304 varies as the full response would
+	cw := fl.compressWriter(rw, req, out.Renderer)
+	if status := fl.conditional(w, req, out, response, buf); status != 0 {
+		rw.WriteHeader(status)
+		return nil
 	}
 
-	err = out.Renderer.Render(w)
+	var err error
+	var target http.ResponseWriter = rw
+	if cw != nil {
+		target = cw
+	}
+
+	if buf != nil {
+		if buf.status != 0 {
+			target.WriteHeader(buf.status)
+		}
+		_, err = target.Write(buf.buf.Bytes())
+	} else {
+		err = render(ctx, out.Renderer, target)
+	}
+
+	if err != nil && !rw.wroteHeader {
+		h := w.Header()
+		for k := range h {
+			delete(h, k)
+		}
+		for k, v := range snapshot {
+			h[k] = v
+		}
+		return err
+	}
+	if cw != nil {
+		if cerr := cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	rw.finish()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		// the status has already been sent, the error can only be logged
+		log.Printf("error rendering %s: %s", req.URL.Path, err)
 	}
+	return nil
+}
+
+// renders the output, passing the context to the renderers that need it
+func render(ctx context.Context, renderer Renderer, w http.ResponseWriter) error {
+	if r, ok := renderer.(ContextRenderer); ok {
+		return r.RenderContext(ctx, w)
+	}
+	return renderer.Render(w)
 }
 
 func (fl *flamel) destroy(ctx context.Context, controller Controller) {
@@ -269,7 +443,7 @@ func (fl *flamel) destroy(ctx context.Context, controller Controller) {
 	fl.app.AfterResponse(ctx)
 }
 
-func (fl flamel) parseRequestInputs(ctx context.Context, req *http.Request) (RequestInputs, error) {
+func (fl *flamel) parseRequestInputs(ctx context.Context, req *http.Request) (RequestInputs, error) {
 	reqValues := make(RequestInputs)
 
 	reqValues[KeyRequestHost] = requestInput{
@@ -300,7 +474,12 @@ func (fl flamel) parseRequestInputs(ctx context.Context, req *http.Request) (Req
 	switch req.Method {
 	case http.MethodDelete:
 		fallthrough
+	case http.MethodHead:
+		fallthrough
 	case http.MethodGet:
+		if req.URL.RawQuery == "" {
+			break
+		}
 		for k, v := range req.URL.Query() {
 			i := requestInput{}
 			i.values = v
@@ -1,14 +1,27 @@
 package flamel
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"decodica.com/flamel/cors"
+	"decodica.com/flamel/websocket"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/aetest"
+	"html/template"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -38,6 +51,13 @@ func (controller *controllerTest) Process(ctx context.Context, out *ResponseOutp
 
 func (controller *controllerTest) OnDestroy(ctx context.Context) {}
 
+// returns a configuration that does not depend on the appengine environment
+func testConfig() Config {
+	config := DefaultConfig()
+	config.Runtime = StandardRuntime{}
+	return config
+}
+
 type userTest struct{}
 
 type authenticatorTest struct {
@@ -50,7 +70,7 @@ const keyUser = "__user__"
 func (self *authenticatorTest) Authenticate(ctx context.Context) context.Context {
 	ins := InputsFromContext(ctx)
 	l := fmt.Sprintf("Authenticating user for request %s", ins[KeyRequestURL].Value())
-	log.Printf(l)
+	log.Print(l)
 	ctx = context.WithValue(ctx, keyUser, &userTest{})
 	user := ctx.Value(keyUser)
 	if user == nil {
@@ -60,31 +80,14 @@ func (self *authenticatorTest) Authenticate(ctx context.Context) context.Context
 }
 
 func BenchmarkRequest_Simple(b *testing.B) {
-	opts := aetest.Options{}
-	opts.StartupTimeout = 60 * time.Second
-	instance, err := aetest.NewInstance(&opts)
-
-	if err != nil {
-		b.Fatalf("Error creating instance %v", err)
-	}
-	defer instance.Close()
-
 	//set up flamel
-	m := Instance()
+	m := New(testConfig(), &appTest{})
 
 	m.SetRoute("/simple", func(ctx context.Context) Controller {
 		return &controllerTest{name: "simple"}
 	}, nil)
 
-	app := &appTest{}
-
-	m.launchApp(app)
-
-	req, err := instance.NewRequest(http.MethodGet, "/simple", nil)
-
-	if err != nil {
-		b.Fatalf("Error creating request %v", err)
-	}
+	req := httptest.NewRequest(http.MethodGet, "/simple", nil)
 
 	b.Run("process route", func(b *testing.B) {
 		b.ReportAllocs()
@@ -102,17 +105,8 @@ func TestMage_Run(t *testing.T) {
 
 	t.Log("*** TEST STARTED ***")
 
-	opts := aetest.Options{}
-	opts.StartupTimeout = 60 * time.Second
-	instance, err := aetest.NewInstance(&opts)
-
-	if err != nil {
-		t.Fatalf("Error creating instance %v", err)
-	}
-	defer instance.Close()
-
 	//set up mage
-	m := Instance()
+	m := New(testConfig(), &appTest{})
 
 	m.SetRoute("", func(ctx context.Context) Controller { return &controllerTest{name: "root"} }, nil)
 	m.SetRoute("/static", func(ctx context.Context) Controller { return &controllerTest{name: "/static"} }, nil)
@@ -143,15 +137,7 @@ func TestMage_Run(t *testing.T) {
 	}, nil)
 	m.SetRoute("/param/:param/:end", func(ctx context.Context) Controller { return &controllerTest{name: "/param/:value/:end"} }, nil)
 
-	app := &appTest{}
-
-	m.launchApp(app)
-
-	req, err := instance.NewRequest(http.MethodGet, "/auth/3", nil)
-
-	if err != nil {
-		t.Fatalf("Error creating request %v", err)
-	}
+	req := httptest.NewRequest(http.MethodGet, "/auth/3", nil)
 	recorder := httptest.NewRecorder()
 	m.run(recorder, req)
 
@@ -165,36 +151,20 @@ func TestMage_Run(t *testing.T) {
 
 func BenchmarkFindRoute(b *testing.B) {
 
-	opts := aetest.Options{}
-	opts.StartupTimeout = 60 * time.Second
-	instance, err := aetest.NewInstance(&opts)
-
-	if err != nil {
-		b.Fatalf("Error creating instance %v", err)
-	}
-	defer instance.Close()
-
 	//set up mage
 	//set up mage instance
-	m := Instance()
+	m := New(testConfig(), &appTest{})
 
 	m.SetRoute("/param/:param/end/:end", func(ctx context.Context) Controller { return &controllerTest{name: "/param/:value/end/:end"} }, nil)
 
-	app := &appTest{}
-
-	m.launchApp(app)
-
-	req, err := instance.NewRequest(http.MethodGet, "/param/5/end/7", nil)
-	if err != nil {
-		b.Fatalf("Error creating request %v", err)
-	}
-	ctx := appengine.NewContext(req)
+	req := httptest.NewRequest(http.MethodGet, "/param/5/end/7", nil)
+	ctx := m.Runtime.NewContext(req)
 
 	b.Run("Find route", func(b *testing.B) {
 		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			_, err, _ = m.Router.RouteForPath(ctx, req.URL.Path)
+			_, err, _ := m.Router.RouteForPath(ctx, req.Method, req.URL.Path)
 			if err != nil {
 				b.Fatalf("Error retrieving route: %s", err)
 			}
@@ -202,3 +172,1415 @@ func BenchmarkFindRoute(b *testing.B) {
 	})
 
 }
+
+func TestNew_Isolated(t *testing.T) {
+	names := []string{"first", "second", "third"}
+	for _, name := range names {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fl := New(testConfig(), &appTest{})
+			fl.SetRoute("/name", func(ctx context.Context) Controller { return &controllerTest{name: name} }, nil)
+
+			mux := http.NewServeMux()
+			mux.Handle("/"+name+"/", http.StripPrefix("/"+name, fl))
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+name+"/name", nil))
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Received status %d with body %s", recorder.Code, recorder.Body.String())
+			}
+
+			if body := recorder.Body.String(); body != name {
+				t.Fatalf("instance %s served body %q", name, body)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(next ProcessFunc) ProcessFunc {
+			return func(ctx context.Context, out *ResponseOutput) HttpResponse {
+				trace = append(trace, name)
+				response := next(ctx, out)
+				trace = append(trace, fmt.Sprintf("%s:%d", name, response.Status))
+				return response
+			}
+		}
+	}
+
+	abort := func(next ProcessFunc) ProcessFunc {
+		return func(ctx context.Context, out *ResponseOutput) HttpResponse {
+			out.Renderer = &TextRenderer{Data: "slow down"}
+			return HttpResponse{Status: http.StatusTooManyRequests}
+		}
+	}
+
+	m.Use(tracer("global"))
+	m.SetRoute("/open", func(ctx context.Context) Controller { return &controllerTest{name: "open"} }, nil, tracer("route"))
+	m.SetRoute("/limited", func(ctx context.Context) Controller { return &controllerTest{name: "limited"} }, nil, abort)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/open", nil))
+	if recorder.Body.String() != "open" {
+		t.Fatalf("unexpected body %q", recorder.Body.String())
+	}
+
+	expected := fmt.Sprint([]string{"global", "route", "route:200", "global:200"})
+	if fmt.Sprint(trace) != expected {
+		t.Fatalf("unexpected middleware trace %v", trace)
+	}
+
+	trace = nil
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/limited", nil))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Body.String() != "slow down" {
+		t.Fatalf("middleware did not abort the request: status %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	if fmt.Sprint(trace) != fmt.Sprint([]string{"global", "global:429"}) {
+		t.Fatalf("unexpected middleware trace %v", trace)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetMethodRoute(http.MethodGet, "/resource", func(ctx context.Context) Controller { return &controllerTest{name: "get"} }, nil)
+	m.SetMethodRoute(http.MethodPost, "/resource", func(ctx context.Context) Controller { return &controllerTest{name: "post"} }, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/resource", nil))
+	if recorder.Body.String() != "post" {
+		t.Fatalf("POST served by the wrong controller: %q", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/resource", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("HEAD not served by the GET route: status %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/resource", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, received %d", recorder.Code)
+	}
+
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD, POST" {
+		t.Fatalf("wrong Allow header %q", allow)
+	}
+}
+
+type countingAuthenticator struct {
+	name  string
+	calls []string
+}
+
+func (a *countingAuthenticator) Authenticate(ctx context.Context) context.Context {
+	a.calls = append(a.calls, a.name)
+	return ctx
+}
+
+func TestGroup(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+
+	admin := &countingAuthenticator{name: "admin"}
+	root := &countingAuthenticator{name: "root"}
+
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(next ProcessFunc) ProcessFunc {
+			return func(ctx context.Context, out *ResponseOutput) HttpResponse {
+				trace = append(trace, name)
+				return next(ctx, out)
+			}
+		}
+	}
+
+	group := m.Group("/admin", admin, tracer("admin"))
+	group.SetRoute("/users", func(ctx context.Context) Controller { return &controllerTest{name: "users"} }, nil, tracer("users"))
+
+	nested := group.Group("/settings/", nil, tracer("settings"))
+	nested.SetMethodRoute(http.MethodGet, "/mail", func(ctx context.Context) Controller { return &controllerTest{name: "mail"} }, nil)
+	nested.SetRoute("/root", func(ctx context.Context) Controller { return &controllerTest{name: "root"} }, root)
+
+	requests := []struct {
+		url   string
+		body  string
+		auth  string
+		trace string
+	}{
+		{"/admin/users", "users", "admin", fmt.Sprint([]string{"admin", "users"})},
+		{"/admin/settings/mail", "mail", "admin", fmt.Sprint([]string{"admin", "settings"})},
+		{"/admin/settings/root", "root", "root", fmt.Sprint([]string{"admin", "settings"})},
+	}
+
+	for _, r := range requests {
+		admin.calls, root.calls, trace = nil, nil, nil
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, r.url, nil))
+
+		if recorder.Body.String() != r.body {
+			t.Fatalf("%s served body %q instead of %q", r.url, recorder.Body.String(), r.body)
+		}
+
+		calls := append(admin.calls, root.calls...)
+		if len(calls) != 1 || calls[0] != r.auth {
+			t.Fatalf("%s authenticated by %v instead of %s", r.url, calls, r.auth)
+		}
+
+		if fmt.Sprint(trace) != r.trace {
+			t.Fatalf("%s executed middlewares %v instead of %s", r.url, trace, r.trace)
+		}
+	}
+}
+
+type urlControllerTest struct{}
+
+func (controller *urlControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	url, err := URLFor(ctx, "product.detail", map[string]string{"id": "42"})
+	if err != nil {
+		out.Renderer = &ErrorRenderer{Data: err}
+		return HttpResponse{Status: http.StatusInternalServerError}
+	}
+	out.Renderer = &TextRenderer{Data: url}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *urlControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestURLFor(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	shop := m.Group("/shop", nil)
+	shop.SetRoute("/products/:id", func(ctx context.Context) Controller { return &urlControllerTest{} }, nil)
+	if err := shop.NameRoute("product.detail", "/products/:id"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/shop/products/1", nil))
+	if recorder.Body.String() != "/shop/products/42" {
+		t.Fatalf("unexpected url %q", recorder.Body.String())
+	}
+
+	tpl := template.Must(template.New("link").Funcs(URLFuncMap(m)).Parse(`<a href="{{urlfor "product.detail" "id" .}}">`))
+	var builder strings.Builder
+	if err := tpl.Execute(&builder, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if builder.String() != `<a href="/shop/products/7">` {
+		t.Fatalf("unexpected template output %s", builder.String())
+	}
+
+	// urls of an instance mounted under a prefix stay under the prefix
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", m))
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/shop/products/1", nil))
+	if recorder.Body.String() != "/admin/shop/products/42" {
+		t.Fatalf("unexpected mounted url %q", recorder.Body.String())
+	}
+
+	tpl = template.Must(template.New("link").Funcs(PrefixedURLFuncMap(m, "/admin/")).Parse(`<a href="{{urlfor "product.detail" "id" .}}">`))
+	builder.Reset()
+	if err := tpl.Execute(&builder, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if builder.String() != `<a href="/admin/shop/products/7">` {
+		t.Fatalf("unexpected mounted template output %s", builder.String())
+	}
+}
+
+type paramsControllerTest struct{}
+
+func (controller *paramsControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	params := RoutingParams(ctx)
+	out.Renderer = &TextRenderer{Data: params["bucket"].Value() + ":" + params["path"].Value()}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *paramsControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestRoutingParams_Wildcard(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/files/:bucket/*path", func(ctx context.Context) Controller { return &paramsControllerTest{} }, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/files/images/2019/logo.png", nil))
+	if body := recorder.Body.String(); body != "images:2019/logo.png" {
+		t.Fatalf("unexpected routing params %q", body)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	factory := func(ctx context.Context) Controller { return &controllerTest{} }
+
+	m.SetMethodRoute(http.MethodGet, "/products/:id", factory, nil)
+	m.SetMethodRoute(http.MethodPut, "/products/:id", factory, &authenticatorTest{t: t})
+	m.NameRoute("product", "/products/:id")
+	admin := m.Group("/admin", &countingAuthenticator{})
+	admin.SetRoute("/users", factory, nil)
+	settings := admin.Group("/settings", nil)
+	settings.SetRoute("/mail", factory, nil)
+
+	if err := m.SetRoute("/products/:key", factory, nil); !errors.Is(err, ErrRouteConflict) {
+		t.Fatalf("expected a route conflict, got %v", err)
+	}
+
+	expected := []RouteInfo{
+		{Pattern: "/admin/settings/mail", Method: "", Authenticator: "*flamel.countingAuthenticator"},
+		{Pattern: "/admin/users", Method: "", Authenticator: "*flamel.countingAuthenticator"},
+		{Pattern: "/products/:id", Method: http.MethodGet, Name: "product"},
+		{Pattern: "/products/:id", Method: http.MethodPut, Name: "product", Authenticator: "*flamel.authenticatorTest"},
+	}
+
+	if routes := m.Routes(); fmt.Sprint(routes) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	if routes := admin.Routes(); len(routes) != 2 || routes[1].Pattern != "/admin/users" {
+		t.Fatalf("unexpected group routes %v", routes)
+	}
+
+	if routes := settings.Routes(); len(routes) != 1 || routes[0].Pattern != "/admin/settings/mail" {
+		t.Fatalf("unexpected nested group routes %v", routes)
+	}
+
+	strict := NewDefaultRouter()
+	strict.Strict = true
+	strict.SetRoute("/:a", factory, nil)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("strict router didn't panic on conflict")
+		}
+	}()
+	strict.SetRoute("/:b", factory, nil)
+}
+
+func TestPathPolicy(t *testing.T) {
+	newInstance := func(policy PathPolicy) *flamel {
+		config := testConfig()
+		config.PathPolicy = policy
+		m := New(config, &appTest{})
+		m.SetRoute("/static", func(ctx context.Context) Controller { return &controllerTest{name: "static"} }, nil)
+		m.SetRoute("/dir/", func(ctx context.Context) Controller { return &controllerTest{name: "dir"} }, nil)
+		return m
+	}
+
+	redirects := []struct {
+		method   string
+		url      string
+		status   int
+		location string
+	}{
+		{http.MethodGet, "/static/?page=2", http.StatusMovedPermanently, "/static?page=2"},
+		{http.MethodGet, "/dir", http.StatusMovedPermanently, "/dir/"},
+		{http.MethodGet, "/dir//../static", http.StatusMovedPermanently, "/static"},
+		{http.MethodPost, "//static", http.StatusPermanentRedirect, "/static"},
+	}
+
+	redirect := newInstance(PathRedirect)
+	lenient := newInstance(PathLenient)
+	strict := newInstance(PathStrict)
+
+	for _, r := range redirects {
+		recorder := httptest.NewRecorder()
+		redirect.ServeHTTP(recorder, httptest.NewRequest(r.method, r.url, nil))
+		if recorder.Code != r.status || recorder.Header().Get("Location") != r.location {
+			t.Fatalf("%s %s: received status %d and location %q", r.method, r.url, recorder.Code, recorder.Header().Get("Location"))
+		}
+
+		recorder = httptest.NewRecorder()
+		lenient.ServeHTTP(recorder, httptest.NewRequest(r.method, r.url, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s %s: lenient policy responded with status %d", r.method, r.url, recorder.Code)
+		}
+
+		recorder = httptest.NewRecorder()
+		strict.ServeHTTP(recorder, httptest.NewRequest(r.method, r.url, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("%s %s: strict policy responded with status %d", r.method, r.url, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	redirect.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/static", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("canonical path responded with status %d", recorder.Code)
+	}
+
+	// redirects of an instance mounted under a prefix stay under the prefix
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", redirect))
+
+	mounted := []struct {
+		url      string
+		location string
+	}{
+		{"/admin/static/?page=2", "/admin/static?page=2"},
+		{"/admin/dir", "/admin/dir/"},
+	}
+
+	for _, r := range mounted {
+		recorder = httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, r.url, nil))
+		if recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != r.location {
+			t.Fatalf("%s: received status %d and location %q", r.url, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+}
+
+func TestErrorHandlers(t *testing.T) {
+	config := testConfig()
+	config.NotFoundHandler = func(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+		ins := InputsFromContext(ctx)
+		out.Renderer = &JSONRenderer{Data: map[string]string{"missing": ins[KeyRequestURL].Value()}}
+		return HttpResponse{Status: http.StatusNotFound}
+	}
+
+	m := New(config, &appTest{})
+	m.SetMethodRoute(http.MethodGet, "/resource", func(ctx context.Context) Controller { return &controllerTest{name: "get"} }, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if recorder.Code != http.StatusNotFound || recorder.Body.String() != "{\"missing\":\"/missing\"}\n" {
+		t.Fatalf("custom not found handler not invoked: status %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/resource", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Body.String() != http.StatusText(http.StatusMethodNotAllowed) {
+		t.Fatalf("default method not allowed handler not invoked: status %d, body %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+type panicControllerTest struct {
+	destroyed *bool
+}
+
+func (controller *panicControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	ins := InputsFromContext(ctx)
+	if ins.Has("crash") {
+		panic("boom")
+	}
+	if ins.Has("stream") {
+		out.Renderer = &StreamRenderer{ContentType: "text/plain", Producer: func(w io.Writer) error {
+			io.WriteString(w, "partial")
+			panic("stream")
+		}}
+		return HttpResponse{Status: http.StatusOK}
+	}
+	out.Renderer = &TextRenderer{Data: fmt.Sprint(ins.MustInt("page"))}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *panicControllerTest) OnDestroy(ctx context.Context) {
+	*controller.destroyed = true
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var recovered *PanicError
+	config := testConfig()
+	config.PanicHandler = func(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+		recovered = err.(*PanicError)
+		return DefaultPanicHandler(ctx, err, out)
+	}
+
+	m := New(config, &appTest{})
+	destroyed := false
+	m.SetRoute("/panic", func(ctx context.Context) Controller { return &panicControllerTest{destroyed: &destroyed} }, nil)
+
+	requests := []struct {
+		url    string
+		status int
+	}{
+		{"/panic?page=2", http.StatusOK},
+		{"/panic", http.StatusBadRequest},
+		{"/panic?page=two", http.StatusBadRequest},
+		{"/panic?crash=true", http.StatusInternalServerError},
+	}
+
+	for _, r := range requests {
+		destroyed, recovered = false, nil
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, r.url, nil))
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s: received status %d instead of %d", r.url, recorder.Code, r.status)
+		}
+
+		if !destroyed {
+			t.Fatalf("%s: controller has not been destroyed", r.url)
+		}
+
+		if r.status != http.StatusOK && (recovered == nil || len(recovered.Stack) == 0) {
+			t.Fatalf("%s: panic handler didn't receive the stack trace", r.url)
+		}
+	}
+
+	if recovered.Value != "boom" {
+		t.Fatalf("unexpected panic value %v", recovered.Value)
+	}
+
+	m.SetRoute("/factory/:id", func(ctx context.Context) Controller {
+		RoutingParams(ctx).MustInt("id")
+		return &controllerTest{}
+	}, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/factory/abc", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("panic in route handler: received status %d", recorder.Code)
+	}
+
+	// a renderer panicking after the status has been sent aborts the response instead of appending an error to it
+	recovered = nil
+	recorder = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Fatalf("the response has not been aborted, recovered %v", r)
+			}
+		}()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/panic?stream=true", nil))
+	}()
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "partial" || recovered != nil {
+		t.Fatalf("panicking stream: received status %d, body %q, panic handler invoked %t", recorder.Code, recorder.Body.String(), recovered != nil)
+	}
+}
+
+type conflictControllerTest struct{}
+
+func (controller *conflictControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	err := NewHTTPError(http.StatusConflict, "the product has been modified")
+	err.Err = errors.New("version mismatch")
+	return out.RenderError(err)
+}
+
+func (controller *conflictControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestProblemRenderer(t *testing.T) {
+	config := testConfig()
+	config.NotFoundHandler = ProblemHandler
+	m := New(config, &appTest{})
+	m.SetRoute("/products/:id", func(ctx context.Context) Controller { return &conflictControllerTest{} }, nil)
+
+	requests := []struct {
+		url         string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"/products/1", "application/problem+json", http.StatusConflict, "application/problem+json"},
+		{"/products/1", "application/json", http.StatusConflict, "application/json"},
+		{"/products/1", "text/html", http.StatusConflict, "text/html"},
+		{"/missing", "application/problem+json", http.StatusNotFound, "application/problem+json"},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, r.url, nil)
+		req.Header.Set("Accept", r.accept)
+		m.ServeHTTP(recorder, req)
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s %s: received status %d instead of %d", r.url, r.accept, recorder.Code, r.status)
+		}
+
+		if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, r.contentType) {
+			t.Fatalf("%s %s: received content type %q", r.url, r.accept, ct)
+		}
+
+		if vary := recorder.Header().Get("Vary"); vary != "Accept" {
+			t.Fatalf("%s %s: received Vary header %q", r.url, r.accept, vary)
+		}
+
+		body := recorder.Body.String()
+		if strings.Contains(body, "version mismatch") {
+			t.Fatalf("%s: the cause of the error has been disclosed: %s", r.url, body)
+		}
+
+		if r.contentType == mimeProblemJSON {
+			problem := make(map[string]interface{})
+			if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("%s: invalid problem document: %s", r.url, err)
+			}
+			if int(problem["status"].(float64)) != r.status || problem["instance"] != r.url {
+				t.Fatalf("%s: unexpected problem document %v", r.url, problem)
+			}
+		}
+	}
+}
+
+type statusControllerTest struct {
+	status int
+}
+
+func (controller *statusControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	out.AppendHeader("Link", "</a>; rel=preload")
+	out.AppendHeader("Link", "</b>; rel=preload")
+	out.AddHeader("Cache-Control", "no-cache")
+	out.AddHeader("Cache-Control", "max-age=60")
+	out.Renderer = &JSONRenderer{Data: "created"}
+	return HttpResponse{Status: controller.status}
+}
+
+func (controller *statusControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestResponseStatus(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/status/:code<int>", func(ctx context.Context) Controller {
+		return &statusControllerTest{status: int(RoutingParams(ctx).MustInt("code"))}
+	}, nil)
+
+	requests := []struct {
+		method string
+		status int
+		body   bool
+	}{
+		{http.MethodPost, http.StatusCreated, true},
+		{http.MethodPost, http.StatusAccepted, true},
+		{http.MethodDelete, http.StatusNoContent, false},
+		{http.MethodGet, http.StatusNotModified, false},
+		{http.MethodHead, http.StatusOK, false},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(r.method, fmt.Sprintf("/status/%d", r.status), nil))
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s: received status %d instead of %d", r.method, recorder.Code, r.status)
+		}
+
+		if hasBody := recorder.Body.Len() > 0; hasBody != r.body {
+			t.Fatalf("%d: unexpected body %q", r.status, recorder.Body.String())
+		}
+
+		if links := recorder.Header()["Link"]; len(links) != 2 {
+			t.Fatalf("%d: expected 2 Link headers, received %v", r.status, links)
+		}
+
+		if cc := recorder.Header()["Cache-Control"]; len(cc) != 1 || cc[0] != "max-age=60" {
+			t.Fatalf("%d: AddHeader should replace the value, received %v", r.status, cc)
+		}
+	}
+}
+
+type streamControllerTest struct{}
+
+func (controller *streamControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	out.SetHeader("Content-Disposition", `attachment; filename="records.ndjson"`)
+	out.Renderer = &NDJSONRenderer{Producer: func(write func(record interface{}) error) error {
+		for i := 0; i < 3; i++ {
+			if err := write(map[string]int{"id": i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *streamControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestStreamRenderer(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/export", func(ctx context.Context) Controller { return &streamControllerTest{} }, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/export", nil))
+
+	if recorder.Code != http.StatusOK || !recorder.Flushed {
+		t.Fatalf("received status %d, flushed %t", recorder.Code, recorder.Flushed)
+	}
+
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("received content type %q", ct)
+	}
+
+	if recorder.Header().Get("Content-Disposition") == "" {
+		t.Fatal("headers of the output have not been sent")
+	}
+
+	expected := "{\"id\":0}\n{\"id\":1}\n{\"id\":2}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("received body %q", body)
+	}
+
+	// a producer failing before writing anything is answered with an error
+	m.SetRoute("/failing", func(ctx context.Context) Controller {
+		return &failingRendererControllerTest{renderer: &NDJSONRenderer{Producer: func(write func(record interface{}) error) error {
+			return errors.New("query failed")
+		}}}
+	}, nil)
+
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/failing", nil))
+	if recorder.Code != http.StatusInternalServerError || recorder.Header().Get("Content-Type") == "application/x-ndjson" {
+		t.Fatalf("failing producer: received status %d with content type %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+}
+
+type sseControllerTest struct {
+	close bool
+}
+
+func (controller *sseControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	from, _ := InputsFromContext(ctx).GetInt(KeyLastEventID)
+	events := make(chan Event)
+	go func() {
+		if controller.close {
+			defer close(events)
+		}
+		for id := from + 1; id <= from+2; id++ {
+			select {
+			case events <- Event{ID: fmt.Sprint(id), Event: "tick", Data: "line\nline"}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	out.Renderer = &SSERenderer{Events: events, Heartbeat: -1}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *sseControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestSSERenderer(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/events", func(ctx context.Context) Controller { return &sseControllerTest{close: true} }, nil)
+	m.SetRoute("/open", func(ctx context.Context) Controller { return &sseControllerTest{} }, nil)
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	m.ServeHTTP(recorder, req)
+
+	if ct := recorder.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("received content type %q", ct)
+	}
+
+	expected := "id: 3\nevent: tick\ndata: line\ndata: line\n\nid: 4\nevent: tick\ndata: line\ndata: line\n\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("received body %q", body)
+	}
+
+	// the stream must end when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/open", nil).WithContext(ctx))
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the stream has not been closed after the client went away")
+	}
+
+	var b strings.Builder
+	if _, err := (Event{Data: "a\r\nb\rc\nd"}).WriteTo(&b); err != nil || b.String() != "data: a\ndata: b\ndata: c\ndata: d\n\n" {
+		t.Fatalf("line breaks not normalized: %q, %v", b.String(), err)
+	}
+
+	for _, e := range []Event{{ID: "1\nevent: forged"}, {Event: "tick\r\ndata: forged"}} {
+		b.Reset()
+		if _, err := e.WriteTo(&b); err == nil || b.Len() != 0 {
+			t.Fatalf("event %+v with line breaks has been written: %q", e, b.String())
+		}
+	}
+}
+
+// performs a websocket handshake against the server and returns the connection, its reader and the handshake response
+func dialWebSocketTest(t *testing.T, server *httptest.Server, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", origin)
+	req.Write(conn)
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res
+}
+
+func TestWebSocket(t *testing.T) {
+	config := testConfig()
+	config.CORS = cors.NewCors([]string{"https://app.example"}, nil, nil)
+	m := New(config, &appTest{})
+
+	authenticated := make(chan bool, 1)
+	session := func(next ProcessFunc) ProcessFunc {
+		return func(ctx context.Context, out *ResponseOutput) HttpResponse {
+			out.AddCookie(http.Cookie{Name: "session", Value: "refreshed"})
+			return next(ctx, out)
+		}
+	}
+	m.SetRoute("/ws", WebSocket(func(ctx context.Context, conn *websocket.Conn) {
+		authenticated <- ctx.Value(keyUser) != nil
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	}), &authenticatorTest{t: t}, session)
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	conn, br, res := dialWebSocketTest(t, server, "https://app.example")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("received status %d", res.StatusCode)
+	}
+	if cookies := res.Cookies(); len(cookies) != 1 || cookies[0].Value != "refreshed" {
+		t.Fatalf("the cookies of the response have not been sent with the handshake: %v", cookies)
+	}
+	if !<-authenticated {
+		t.Fatal("the websocket route has not been authenticated")
+	}
+
+	// unframed text message: fin and opcode, length, payload
+	expected := []byte{0x81, 5, 'h', 'e', 'l', 'l', 'o'}
+	frame := make([]byte, len(expected))
+	if _, err := io.ReadFull(br, frame); err != nil || !bytes.Equal(frame, expected) {
+		t.Fatalf("received frame %v, error %v", frame, err)
+	}
+
+	if _, _, res := dialWebSocketTest(t, server, "https://evil.example"); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross origin request received status %d", res.StatusCode)
+	}
+}
+
+type versionedControllerTest struct{}
+
+var versionedModTest = time.Date(2019, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+func (controller *versionedControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	ins := InputsFromContext(ctx)
+	switch ins[KeyRequestMethod].Value() {
+	case http.MethodPut:
+		out.SetETag("v2")
+		if response, failed := out.CheckPreconditions(ctx); failed {
+			return response
+		}
+		return HttpResponse{Status: http.StatusNoContent}
+	}
+	out.SetLastModified(versionedModTest)
+	out.Renderer = &TextRenderer{Data: "product"}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *versionedControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestConditionalRequests(t *testing.T) {
+	config := testConfig()
+	config.AutoETag = true
+	m := New(config, &appTest{})
+	m.SetRoute("/product", func(ctx context.Context) Controller { return &versionedControllerTest{} }, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/product", nil))
+	etag := recorder.Header().Get("ETag")
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) || recorder.Body.String() != "product" {
+		t.Fatalf("received status %d, etag %q, body %q", recorder.Code, etag, recorder.Body.String())
+	}
+
+	requests := []struct {
+		method string
+		header string
+		value  string
+		status int
+	}{
+		{http.MethodGet, "If-None-Match", etag, http.StatusNotModified},
+		{http.MethodGet, "If-None-Match", `"a", ` + strings.TrimPrefix(etag, "W/"), http.StatusNotModified},
+		{http.MethodGet, "If-None-Match", `"other"`, http.StatusOK},
+		{http.MethodGet, "If-Modified-Since", versionedModTest.Format(http.TimeFormat), http.StatusNotModified},
+		{http.MethodGet, "If-Modified-Since", versionedModTest.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+		{http.MethodGet, "If-Match", etag, http.StatusPreconditionFailed},
+		{http.MethodPut, "If-Match", `"v2"`, http.StatusNoContent},
+		{http.MethodPut, "If-Match", `"v1"`, http.StatusPreconditionFailed},
+		{http.MethodPut, "If-Match", `W/"v2"`, http.StatusPreconditionFailed},
+		{http.MethodPut, "If-None-Match", "*", http.StatusPreconditionFailed},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(r.method, "/product", nil)
+		req.Header.Set(r.header, r.value)
+		m.ServeHTTP(recorder, req)
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s %s: %s received status %d instead of %d", r.method, r.header, r.value, recorder.Code, r.status)
+		}
+
+		if r.status == http.StatusNotModified && (recorder.Body.Len() > 0 || recorder.Header().Get("ETag") != etag) {
+			t.Fatalf("%s: %s unexpected not modified response", r.header, r.value)
+		}
+	}
+}
+
+type downloadControllerTest struct {
+	data []byte
+}
+
+func (controller *downloadControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	out.Renderer = &DownloadRenderer{Mime: "text/plain", Encoding: "UTF-8", FileName: "data.txt", Data: controller.data}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *downloadControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestCompression(t *testing.T) {
+	config := testConfig()
+	config.Compression = DefaultCompression()
+	m := New(config, &appTest{})
+
+	large := strings.Repeat("flamel ", 500)
+	m.SetRoute("/large", func(ctx context.Context) Controller { return &controllerTest{name: large} }, nil)
+	m.SetRoute("/small", func(ctx context.Context) Controller { return &controllerTest{name: "small"} }, nil)
+	m.SetRoute("/download", func(ctx context.Context) Controller { return &downloadControllerTest{data: []byte(large)} }, nil)
+
+	requests := []struct {
+		url      string
+		accept   string
+		encoding string
+		vary     bool
+	}{
+		{"/large", "gzip, deflate", "gzip", true},
+		{"/large", "gzip;q=0.5, deflate", "deflate", true},
+		{"/large", "br, *;q=0.1", "gzip", true},
+		{"/large", "gzip;q=0", "", true},
+		{"/large", "", "", true},
+		{"/small", "gzip", "", true},
+		{"/download", "gzip", "", false},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, r.url, nil)
+		if r.accept != "" {
+			req.Header.Set("Accept-Encoding", r.accept)
+		}
+		m.ServeHTTP(recorder, req)
+
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != r.encoding {
+			t.Fatalf("%s %s: received encoding %q instead of %q", r.url, r.accept, encoding, r.encoding)
+		}
+
+		if vary := recorder.Header().Get("Vary") == "Accept-Encoding"; vary != r.vary {
+			t.Fatalf("%s %s: unexpected Vary header %q", r.url, r.accept, recorder.Header().Get("Vary"))
+		}
+
+		var body io.Reader = recorder.Body
+		switch r.encoding {
+		case "gzip":
+			body, _ = gzip.NewReader(body)
+		case "deflate":
+			body, _ = zlib.NewReader(body)
+		}
+		content, _ := io.ReadAll(body)
+		if r.url == "/large" && string(content) != large {
+			t.Fatalf("%s %s: unexpected content after decompression", r.url, r.accept)
+		}
+	}
+	// a not modified response varies as the full response does
+	config.AutoETag = true
+	m = New(config, &appTest{})
+	m.SetRoute("/large", func(ctx context.Context) Controller { return &controllerTest{name: large} }, nil)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/large", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", recorder.Header().Get("ETag"))
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusNotModified || recorder.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("received status %d with Vary header %q", recorder.Code, recorder.Header().Get("Vary"))
+	}
+}
+
+type fileControllerTest struct{}
+
+func (controller *fileControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	out.Renderer = &FileRenderer{Mime: "video/mp4", ModTime: versionedModTest, Data: strings.NewReader("0123456789")}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *fileControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestRangeRequests(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/download", func(ctx context.Context) Controller { return &downloadControllerTest{data: []byte("0123456789")} }, nil)
+	m.SetRoute("/video", func(ctx context.Context) Controller { return &fileControllerTest{} }, nil)
+
+	requests := []struct {
+		url         string
+		header      map[string]string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"/download", nil, http.StatusOK, "0123456789", "text/plain"},
+		{"/download", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234", "text/plain"},
+		{"/download", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789", "text/plain"},
+		{"/download", map[string]string{"Range": "bytes=0-1,5-6"}, http.StatusPartialContent, "", "multipart/byteranges"},
+		{"/download", map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "", ""},
+		{"/video", map[string]string{"Range": "bytes=5-"}, http.StatusPartialContent, "56789", "video/mp4"},
+		{"/video", map[string]string{"Range": "bytes=5-", "If-Range": versionedModTest.Format(http.TimeFormat)}, http.StatusPartialContent, "56789", "video/mp4"},
+		{"/video", map[string]string{"Range": "bytes=5-", "If-Range": versionedModTest.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, "0123456789", "video/mp4"},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, r.url, nil)
+		for k, v := range r.header {
+			req.Header.Set(k, v)
+		}
+		m.ServeHTTP(recorder, req)
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s %v: received status %d instead of %d", r.url, r.header, recorder.Code, r.status)
+		}
+
+		if r.body != "" && recorder.Body.String() != r.body {
+			t.Fatalf("%s %v: received body %q", r.url, r.header, recorder.Body.String())
+		}
+
+		if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, r.contentType) {
+			t.Fatalf("%s %v: received content type %q", r.url, r.header, ct)
+		}
+
+		if r.status != http.StatusRequestedRangeNotSatisfiable && recorder.Header().Get("Accept-Ranges") != "bytes" {
+			t.Fatalf("%s %v: ranges are not advertised", r.url, r.header)
+		}
+
+		if r.contentType == "multipart/byteranges" {
+			checkByteRangesTest(t, recorder, []string{"01", "56"}, []string{"bytes 0-1/10", "bytes 5-6/10"})
+		}
+	}
+}
+
+// checks that the multipart/byteranges response contains the given parts, in order
+func checkByteRangesTest(t *testing.T, recorder *httptest.ResponseRecorder, bodies []string, ranges []string) {
+	_, params, err := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := multipart.NewReader(recorder.Body, params["boundary"])
+	for i := range bodies {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+
+		content, _ := io.ReadAll(part)
+		if string(content) != bodies[i] || part.Header.Get("Content-Range") != ranges[i] {
+			t.Fatalf("part %d: received %q with range %q", i, content, part.Header.Get("Content-Range"))
+		}
+	}
+
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Fatalf("unexpected parts after the requested ranges: %v", err)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	files := fstest.MapFS{
+		"css/main.css": {Data: []byte("body { color: red; }")},
+		"index.html":   {Data: []byte("<html>home</html>")},
+		"data":         {Data: []byte("<html>sniffed</html>")},
+	}
+
+	m := New(testConfig(), &appTest{})
+	static := NewStatic(files, "/static")
+	if err := static.SetRoute(m, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := template.Must(template.New("page").Funcs(AssetFuncMap(static)).Parse(`{{asset "css/main.css"}}`))
+	var asset strings.Builder
+	if err := tmpl.Execute(&asset, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(asset.String(), "/static/css/main.") || asset.String() == "/static/css/main.css" {
+		t.Fatalf("unexpected asset url %s", asset.String())
+	}
+
+	requests := []struct {
+		url          string
+		status       int
+		contentType  string
+		cacheControl string
+	}{
+		{"/static/css/main.css", http.StatusOK, "text/css", "public, no-cache"},
+		{asset.String(), http.StatusOK, "text/css", "public, max-age=31536000, immutable"},
+		{"/static/css/main.0123456789abcdef.css", http.StatusNotFound, "", ""},
+		{"/static/", http.StatusOK, "text/html", "public, no-cache"},
+		{"/static/data", http.StatusOK, "text/html", "public, no-cache"},
+		{"/static/css", http.StatusNotFound, "", ""},
+		{"/static/../flamel.go", http.StatusNotFound, "", ""},
+		{"/static/%2e%2e/flamel.go", http.StatusNotFound, "", ""},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, r.url, nil))
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s: received status %d instead of %d", r.url, recorder.Code, r.status)
+		}
+
+		if r.status != http.StatusOK {
+			continue
+		}
+
+		if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, r.contentType) {
+			t.Fatalf("%s: received content type %q", r.url, ct)
+		}
+
+		if cc := recorder.Header().Get("Cache-Control"); cc != r.cacheControl {
+			t.Fatalf("%s: received cache control %q", r.url, cc)
+		}
+
+		// the files are revalidated with their entity tag
+		req := httptest.NewRequest(http.MethodGet, r.url, nil)
+		req.Header.Set("If-None-Match", recorder.Header().Get("ETag"))
+		recorder = httptest.NewRecorder()
+		m.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusNotModified {
+			t.Fatalf("%s: revalidation received status %d", r.url, recorder.Code)
+		}
+	}
+
+	// assets served by a group of an instance mounted under a prefix
+	grouped := NewStatic(files, "/static")
+	grouped.MountPrefix = "/admin"
+	if err := grouped.SetRoute(m.Group("/theme", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := grouped.AssetPath("css/main.css")
+	if err != nil || path != "/admin/theme"+asset.String() {
+		t.Fatalf("unexpected grouped asset path %s, %v", path, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", m))
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "body { color: red; }" {
+		t.Fatalf("%s: received status %d", path, recorder.Code)
+	}
+}
+
+type pageControllerTest struct{}
+
+func (controller *pageControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	data := struct {
+		Name  string
+		Price int
+	}{"lamp", 42}
+	if err := TemplatesFromContext(ctx).Render(out, "products/show", data); err != nil {
+		return out.RenderError(err)
+	}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *pageControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestTemplates(t *testing.T) {
+	files := fstest.MapFS{
+		"layouts/base.html":        {Data: []byte(`<main>{{block "content" .}}{{end}}</main>`)},
+		"partials/price.html":      {Data: []byte(`{{.}} EUR`)},
+		"pages/products/show.html": {Data: []byte(`{{template "base" .}}{{define "content"}}{{upper .Name}}: {{template "price" .Price}}{{end}}`)},
+	}
+
+	config := testConfig()
+	config.Templates = NewTemplates(files, template.FuncMap{"upper": strings.ToUpper})
+	config.Templates.Reload = true
+	m := New(config, &appTest{})
+	m.SetRoute("/product", func(ctx context.Context) Controller { return &pageControllerTest{} }, nil)
+
+	render := func() string {
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/product", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("received status %d", recorder.Code)
+		}
+		return recorder.Body.String()
+	}
+
+	if body := render(); body != "<main>LAMP: 42 EUR</main>" {
+		t.Fatalf("unexpected page %q", body)
+	}
+
+	// the templates are parsed again when a file changes
+	files["partials/price.html"] = &fstest.MapFile{Data: []byte(`EUR {{.}}`), ModTime: time.Now()}
+	if body := render(); body != "<main>LAMP: EUR 42</main>" {
+		t.Fatalf("the templates have not been reloaded: %q", body)
+	}
+
+	if _, err := config.Templates.Lookup("products/missing"); err == nil {
+		t.Fatal("a missing page has been found")
+	}
+}
+
+type failingRendererControllerTest struct {
+	renderer Renderer
+}
+
+func (controller *failingRendererControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	out.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+	out.SetETag("v1")
+	out.Renderer = controller.renderer
+	return HttpResponse{Status: http.StatusCreated}
+}
+
+func (controller *failingRendererControllerTest) OnDestroy(ctx context.Context) {}
+
+// an unbuffered renderer failing before writing anything
+type failingReportRendererTest struct{}
+
+func (renderer *failingReportRendererTest) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+	return errors.New("query failed")
+}
+
+func TestRenderError(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	tmpl := template.Must(template.New("page").Parse(`<p>{{template "missing" .}}</p>`))
+	m.SetRoute("/json", func(ctx context.Context) Controller {
+		return &failingRendererControllerTest{renderer: &JSONRenderer{Data: map[string]interface{}{"ok": true, "ch": make(chan int)}}}
+	}, nil)
+	m.SetRoute("/template", func(ctx context.Context) Controller {
+		return &failingRendererControllerTest{renderer: &TemplateRenderer{Template: tmpl, TemplateName: "page", Data: map[string]int{}}}
+	}, nil)
+
+	m.SetRoute("/report", func(ctx context.Context) Controller {
+		return &failingRendererControllerTest{renderer: &failingReportRendererTest{}}
+	}, nil)
+
+	for _, url := range []string{"/json", "/template", "/report"} {
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+
+		if recorder.Code != http.StatusInternalServerError {
+			t.Fatalf("%s: received status %d", url, recorder.Code)
+		}
+
+		if body := recorder.Body.String(); body != http.StatusText(http.StatusInternalServerError) {
+			t.Fatalf("%s: the response is not clean: %q", url, body)
+		}
+
+		if ct := recorder.Header().Get("Content-Type"); strings.HasPrefix(ct, "application/json") {
+			t.Fatalf("%s: received content type %q", url, ct)
+		}
+
+		for _, h := range []string{"Cache-Control", "ETag", "Content-Disposition"} {
+			if v := recorder.Header().Get(h); v != "" {
+				t.Fatalf("%s: the error response has the %s header of the failed one: %q", url, h, v)
+			}
+		}
+	}
+}
+
+type negotiatedControllerTest struct{}
+
+func (controller *negotiatedControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	tmpl := template.Must(template.New("product").Parse(`<h1>{{.}}</h1>`))
+	out.Renderer = &NegotiatedRenderer{
+		Data: "lamp",
+		Renderers: map[string]DataRenderer{
+			"text/html":        RenderTemplate(tmpl, "product"),
+			"application/json": RenderJSON,
+			"text/plain":       RenderText,
+		},
+	}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *negotiatedControllerTest) OnDestroy(ctx context.Context) {}
+
+func (controller *negotiatedControllerTest) DefaultOffer() string {
+	return "text/html"
+}
+
+func (controller *negotiatedControllerTest) Offers() []string {
+	return []string{"text/html", "application/json", "text/plain"}
+}
+
+func (controller *negotiatedControllerTest) Strict() bool {
+	return true
+}
+
+func TestNegotiatedRenderer(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/product", func(ctx context.Context) Controller { return &negotiatedControllerTest{} }, nil)
+
+	requests := []struct {
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"", http.StatusOK, "", "<h1>lamp</h1>"},
+		{"application/json", http.StatusOK, "application/json", "\"lamp\"\n"},
+		{"text/plain, text/html;q=0.5", http.StatusOK, "text/plain", "lamp"},
+		{"image/png", http.StatusNotAcceptable, "text/plain", http.StatusText(http.StatusNotAcceptable)},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/product", nil)
+		if r.accept != "" {
+			req.Header.Set("Accept", r.accept)
+		}
+		m.ServeHTTP(recorder, req)
+
+		if recorder.Code != r.status {
+			t.Fatalf("%s: received status %d instead of %d", r.accept, recorder.Code, r.status)
+		}
+
+		if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, r.contentType) {
+			t.Fatalf("%s: received content type %q", r.accept, ct)
+		}
+
+		if vary := recorder.Header()["Vary"]; len(vary) != 1 || vary[0] != "Accept" {
+			t.Fatalf("%s: received Vary header %v", r.accept, vary)
+		}
+
+		if body := recorder.Body.String(); body != r.body {
+			t.Fatalf("%s: received body %q", r.accept, body)
+		}
+	}
+}
+
+type feedItemTest struct {
+	XMLName struct{} `xml:"item" csv:"-" msgpack:"-"`
+	ID      int      `xml:"id,attr" csv:"id" msgpack:"id"`
+	Name    string   `xml:"name" csv:"name" msgpack:"name"`
+	Price   float64  `xml:"-" csv:"price" msgpack:"price,omitempty"`
+	secret  string
+}
+
+type feedControllerTest struct{}
+
+func (controller *feedControllerTest) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	items := []feedItemTest{{ID: 1, Name: "lamp", Price: 9.5}, {ID: 2, Name: "chair, red"}}
+	out.Renderer = &NegotiatedRenderer{
+		Data: items,
+		Renderers: map[string]DataRenderer{
+			"application/json":    RenderJSON,
+			"application/xml":     RenderXML,
+			"text/csv":            RenderCSV,
+			"application/msgpack": RenderMessagePack,
+		},
+		Default: "application/json",
+	}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *feedControllerTest) OnDestroy(ctx context.Context) {}
+
+func TestFormatRenderers(t *testing.T) {
+	m := New(testConfig(), &appTest{})
+	m.SetRoute("/feed", func(ctx context.Context) Controller { return &feedControllerTest{} }, nil)
+
+	requests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"application/xml", "application/xml; charset=UTF-8", xmlHeaderTest + `<item id="1"><name>lamp</name></item><item id="2"><name>chair, red</name></item>`},
+		{"text/csv", "text/csv; charset=UTF-8", "id,name,price\n1,lamp,9.5\n2,\"chair, red\",0\n"},
+		{"application/msgpack", "application/msgpack", "\x92" +
+			"\x83\xa2id\x01\xa4name\xa4lamp\xa5price\xcb\x40\x23\x00\x00\x00\x00\x00\x00" +
+			"\x82\xa2id\x02\xa4name\xaachair, red"},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/feed", nil)
+		req.Header.Set("Accept", r.accept)
+		m.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: received status %d", r.accept, recorder.Code)
+		}
+
+		if ct := recorder.Header().Get("Content-Type"); ct != r.contentType {
+			t.Fatalf("%s: received content type %q", r.accept, ct)
+		}
+
+		if body := recorder.Body.String(); body != r.body {
+			t.Fatalf("%s: received body %q", r.accept, body)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	records := [][]string{{"a", "b"}, {"1", "2"}}
+	if err := (&CSVRenderer{Data: records, Comma: ';'}).Render(recorder); err != nil {
+		t.Fatal(err)
+	}
+	if body := recorder.Body.String(); body != "a;b\n1;2\n" {
+		t.Fatalf("received csv %q", body)
+	}
+
+	var buf bytes.Buffer
+
+	values := []struct {
+		value interface{}
+		out   string
+	}{
+		{nil, "\xc0"},
+		{true, "\xc3"},
+		{-1, "\xff"},
+		{-200, "\xd1\xff\x38"},
+		{300, "\xcd\x01\x2c"},
+		{[]byte{1, 2}, "\xc4\x02\x01\x02"},
+		{map[string]int{"b": 2, "a": 1}, "\x82\xa1a\x01\xa1b\x02"},
+		{time.Unix(1, 0), "\xd6\xff\x00\x00\x00\x01"},
+	}
+	for _, v := range values {
+		buf.Reset()
+		if err := NewMessagePackEncoder(&buf).Encode(v.value); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != v.out {
+			t.Fatalf("%v: encoded to %x instead of %x", v.value, buf.String(), v.out)
+		}
+	}
+
+	if err := NewMessagePackEncoder(&buf).Encode(make(chan int)); err == nil {
+		t.Fatal("channels should not be encoded")
+	}
+}
+
+const xmlHeaderTest = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
@@ -0,0 +1,171 @@
+package flamel
+
+import (
+	"encoding"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+const (
+	mimeXML         = "application/xml"
+	mimeCSV         = "text/csv"
+	mimeMessagePack = "application/msgpack"
+)
+
+// Renders the data as an XML document, as encoding/xml marshals it
+type XMLRenderer struct {
+	Data interface{}
+}
+
+func (renderer *XMLRenderer) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(renderer.Data)
+}
+
+// Renders the data as CSV records. Data is either a [][]string, whose rows are written as they are,
+// or a slice of structs, or of pointers to structs, which is written with a header row.
+// The columns are the exported fields of the struct, named after their "csv" tag, if any. Fields tagged "-" are skipped.
+// Values implementing encoding.TextMarshaler are written as marshaled, any other value as fmt.Sprint formats it
+type CSVRenderer struct {
+	Data interface{}
+	// the field delimiter. Defaults to ','
+	Comma rune
+}
+
+func (renderer *CSVRenderer) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+
+	records, err := csvRecords(renderer.Data)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if renderer.Comma != 0 {
+		cw.Comma = renderer.Comma
+	}
+	return cw.WriteAll(records)
+}
+
+// a column of a CSV record, mapped to a struct field
+type csvColumn struct {
+	name  string
+	index int
+}
+
+func csvColumns(t reflect.Type) []csvColumn {
+	var columns []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Tag.Get("csv")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		columns = append(columns, csvColumn{name: name, index: i})
+	}
+	return columns
+}
+
+func csvValue(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface()), nil
+}
+
+// converts the data to CSV records
+func csvRecords(data interface{}) ([][]string, error) {
+	if records, ok := data.([][]string); ok {
+		return records, nil
+	}
+
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("csv: unsupported data type %T", data)
+	}
+
+	elem := v.Type().Elem()
+	pointers := elem.Kind() == reflect.Ptr
+	if pointers {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("csv: unsupported data type %T", data)
+	}
+
+	columns := csvColumns(elem)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+
+	records := make([][]string, 0, v.Len()+1)
+	records = append(records, header)
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		if pointers {
+			if item.IsNil() {
+				continue
+			}
+			item = item.Elem()
+		}
+
+		record := make([]string, len(columns))
+		for j, c := range columns {
+			value, err := csvValue(item.Field(c.index))
+			if err != nil {
+				return nil, err
+			}
+			record[j] = value
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Renders the data as MessagePack, a compact binary alternative to JSON
+type MessagePackRenderer struct {
+	Data interface{}
+}
+
+func (renderer *MessagePackRenderer) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", mimeMessagePack)
+	return NewMessagePackEncoder(w).Encode(renderer.Data)
+}
+
+// Renders data as an XML document
+func RenderXML(data interface{}) Renderer {
+	return &XMLRenderer{Data: data}
+}
+
+// Renders data as CSV records
+func RenderCSV(data interface{}) Renderer {
+	return &CSVRenderer{Data: data}
+}
+
+// Renders data as MessagePack
+func RenderMessagePack(data interface{}) Renderer {
+	return &MessagePackRenderer{Data: data}
+}
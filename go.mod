@@ -1,7 +1,10 @@
 module decodica.com/flamel
 
+go 1.16
+
 require (
-	github.com/golang/protobuf v1.3.2 // indirect
 	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 	google.golang.org/appengine v1.6.5
 )
+
+require github.com/golang/protobuf v1.3.2 // indirect
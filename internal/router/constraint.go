@@ -0,0 +1,124 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A constraint restricts the values accepted by a route parameter.
+// Constraints are declared after the parameter name, enclosed in angle brackets: ":id<int>", ":slug<[a-z-]+>".
+// Besides the named constraints below, any regular expression matching a whole segment is accepted.
+type constraint struct {
+	// the expression as written in the route pattern
+	expr  string
+	match func(value string) bool
+}
+
+const (
+	constraintOpen  = '<'
+	constraintClose = '>'
+)
+
+// named constraints
+var constraints = map[string]func(value string) bool{
+	"int":   isInt,
+	"uuid":  isUUID,
+	"alpha": isAlpha,
+	"alnum": isAlnum,
+}
+
+func isInt(value string) bool {
+	if len(value) > 0 && value[0] == '-' {
+		value = value[1:]
+	}
+	if len(value) == 0 {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// accepts the canonical textual representation of an uuid: 8-4-4-4-12 hex digits
+func isUUID(value string) bool {
+	if len(value) != 36 {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if value[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(value[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isAlpha(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return len(value) > 0
+}
+
+func isAlnum(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return len(value) > 0
+}
+
+func newConstraint(expr string) (*constraint, error) {
+	if match, ok := constraints[expr]; ok {
+		return &constraint{expr: expr, match: match}, nil
+	}
+
+	if strings.IndexByte(expr, '/') != -1 {
+		return nil, fmt.Errorf("constraint %q can't match the path separator", expr)
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid constraint %q: %s", expr, err)
+	}
+	return &constraint{expr: expr, match: re.MatchString}, nil
+}
+
+// splits a parameter segment, i.e. ":id<int>", into the parameter name and its constraint.
+// The constraint is nil if the segment doesn't declare any
+func parseParameter(segment string) (string, *constraint, error) {
+	name := segment[1:]
+	open := strings.IndexByte(name, constraintOpen)
+	if open == -1 {
+		return name, nil, nil
+	}
+
+	if name[len(name)-1] != constraintClose {
+		return "", nil, fmt.Errorf("unterminated constraint in segment %q", segment)
+	}
+
+	c, err := newConstraint(name[open+1 : len(name)-1])
+	if err != nil {
+		return "", nil, err
+	}
+	return name[:open], c, nil
+}
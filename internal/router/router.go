@@ -3,7 +3,11 @@ package router
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -17,6 +21,21 @@ const (
 
 var ErrRouteNotFound = errors.New("can't find route")
 
+var ErrNamedRouteNotFound = errors.New("can't find named route")
+
+// Returned when a route can't be set because it is already set or it is ambiguous with an existing route
+var ErrRouteConflict = errors.New("route conflict")
+
+// Returned when the path matches a route that has no handler for the requested method
+type MethodNotAllowedError struct {
+	// methods accepted by the route
+	Allowed []string
+}
+
+func (e MethodNotAllowedError) Error() string {
+	return "method not allowed"
+}
+
 const RoutingParamsKey = "__flamel_routing_params__"
 
 const paramRegex = `:(\w+)`
@@ -25,6 +44,15 @@ const paramChar = ':'
 
 var paramTester = regexp.MustCompile(paramRegex)
 
+// returns the key a wildcard segment captures the path with: the name following the wildcard char, i.e. "*rest",
+// or the wildcard char itself for anonymous wildcards
+func wildcardKey(segment string) string {
+	if len(segment) > 1 {
+		return segment[1:]
+	}
+	return string(wildcardChar)
+}
+
 func extractParameter(par string) string {
 	if !paramTester.MatchString(par) {
 		return ""
@@ -39,42 +67,175 @@ type Param struct {
 
 type Params []Param
 
+type Handler func(ctx context.Context) (interface{}, context.Context)
+
 //Route class
 type Route struct {
-	Name    string
-	Handler func(ctx context.Context) (interface{}, context.Context)
+	// the path pattern the route has been set for, i.e. "/products/:id"
+	Pattern string
+	// logical name of the route, used to build its url. It can be empty
+	Name string
+	// handler invoked for any method without a specific handler
+	Handler Handler
+	// method specific handlers
+	handlers map[string]Handler
+	// true if Handler has been set
+	anyMethod bool
 	// factory   func() Controller
 	routeType routeType
 }
 
-func NewRoute(url string, handler func(ctx context.Context) (interface{}, context.Context)) Route {
+func NewRoute(url string, handler Handler) Route {
 	//analyze the name to determine the route type
-	route := Route{Handler: handler}
+	route := Route{Handler: handler, anyMethod: handler != nil}
 
 	if par := extractParameter(url); par != "" {
-		route.Name = url
+		route.Pattern = url
 		route.routeType = parameter
 		return route
 	}
 
 	if strings.Index(url, string(wildcardChar)) != -1 {
-		route.Name = url
+		route.Pattern = url
 		route.routeType = wildcard
 		return route
 	}
 
-	route.Name = url
+	route.Pattern = url
 	route.routeType = static
 	return route
 }
 
+// assigns the handler to the given method. An empty method assigns the handler to every method
+func (route *Route) setHandler(method string, handler Handler) {
+	if method == "" {
+		route.Handler = handler
+		route.anyMethod = true
+		return
+	}
+
+	if route.handlers == nil {
+		route.handlers = make(map[string]Handler)
+	}
+	route.handlers[method] = handler
+}
+
+// returns true if a handler has been set for the method
+func (route *Route) hasHandler(method string) bool {
+	if method == "" {
+		return route.anyMethod
+	}
+	_, ok := route.handlers[method]
+	return ok
+}
+
+// returns the handler for the requested method.
+// HEAD requests are served by the GET handler if no specific handler is set
+func (route *Route) handler(method string) Handler {
+	if h, ok := route.handlers[method]; ok {
+		return h
+	}
+
+	if method == http.MethodHead {
+		if h, ok := route.handlers[http.MethodGet]; ok {
+			return h
+		}
+	}
+
+	return route.Handler
+}
+
+// Returns the sorted list of methods with a specific handler.
+// If the route accepts any method it returns nil
+func (route *Route) Methods() []string {
+	if route.Handler != nil {
+		return nil
+	}
+
+	methods := make([]string, 0, len(route.handlers)+1)
+	for m := range route.handlers {
+		methods = append(methods, m)
+	}
+
+	if _, get := route.handlers[http.MethodGet]; get {
+		if _, head := route.handlers[http.MethodHead]; !head {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+
+	sort.Strings(methods)
+	return methods
+}
+
+// Returns the sorted list of methods a handler has been set for.
+// An empty method stands for the handler serving any method
+func (route *Route) SetMethods() []string {
+	methods := make([]string, 0, len(route.handlers)+1)
+	if route.anyMethod {
+		methods = append(methods, "")
+	}
+	for m := range route.handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Builds the url of the route by replacing its parameters with the given values.
+// Values are path escaped. Wildcards are replaced by the value of their name, "*" for anonymous wildcards,
+// and the segments of the value are escaped one by one.
+func (route *Route) URL(params map[string]string) (string, error) {
+	var builder strings.Builder
+	pattern := route.Pattern
+	for len(pattern) > 0 {
+		end := strings.IndexByte(pattern, '/')
+		if end == -1 {
+			end = len(pattern)
+		}
+		segment := pattern[:end]
+
+		switch {
+		case segment == "":
+		case segment[0] == paramChar:
+			key, c, err := parseParameter(segment)
+			if err != nil {
+				return "", err
+			}
+			value, ok := params[key]
+			if !ok || value == "" {
+				return "", fmt.Errorf("missing value for parameter %q of route %q", key, route.Pattern)
+			}
+			if c != nil && !c.match(value) {
+				return "", fmt.Errorf("value %q of parameter %q doesn't satisfy constraint %q", value, key, c.expr)
+			}
+			builder.WriteString(url.PathEscape(value))
+		case segment[0] == wildcardChar:
+			tail := strings.Split(params[wildcardKey(segment)], "/")
+			for i, t := range tail {
+				tail[i] = url.PathEscape(t)
+			}
+			builder.WriteString(strings.Join(tail, "/"))
+		default:
+			builder.WriteString(segment)
+		}
+
+		if end < len(pattern) {
+			builder.WriteByte('/')
+			end++
+		}
+		pattern = pattern[end:]
+	}
+
+	return builder.String(), nil
+}
+
 func (route Route) match(url string) bool {
-	//log.Printf("url %s, rest %s, route.Name %s ", url, rest, route.Name)
+	//log.Printf("url %s, rest %s, route.Pattern %s ", url, rest, route.Pattern)
 	switch route.routeType {
 	case parameter:
 		return true
 	case static:
-		return route.Name == url
+		return route.Pattern == url
 	case wildcard:
 		return true
 	}
@@ -84,30 +245,112 @@ func (route Route) match(url string) bool {
 
 type Router struct {
 	tree *tree
+	// routes indexed by their path
+	routes map[string]*Route
+	// routes indexed by their name
+	names map[string]*Route
 }
 
 func NewRouter() Router {
 	router := Router{}
 	router.tree = newTree()
+	router.routes = make(map[string]*Route)
+	router.names = make(map[string]*Route)
 	return router
 }
 
 // Creates the path - route relationship.
-// handler is invoked once the route is found
-func (router *Router) SetRoute(path string, handler func(ctx context.Context) (interface{}, context.Context)) {
-	route := NewRoute(path, handler)
-	router.tree.insert(&route)
+// handler is invoked once the route is found, whatever the request method
+func (router *Router) SetRoute(path string, handler Handler) error {
+	return router.SetMethodRoute("", path, handler)
+}
+
+// Creates the path - route relationship for the given method.
+// Handlers for different methods of the same path share the same route.
+// Returns an error wrapping ErrRouteConflict if the method has already been set for the path,
+// or if the path is ambiguous with the one of an existing route
+func (router *Router) SetMethodRoute(method string, path string, handler Handler) error {
+	if route, ok := router.routes[path]; ok {
+		if route.hasHandler(method) {
+			if method == "" {
+				return fmt.Errorf("%w: %q is already set", ErrRouteConflict, path)
+			}
+			return fmt.Errorf("%w: %s %q is already set", ErrRouteConflict, method, path)
+		}
+		route.setHandler(method, handler)
+		return nil
+	}
+
+	route := NewRoute(path, nil)
+	route.setHandler(method, handler)
+	if err := router.tree.insert(&route); err != nil {
+		return fmt.Errorf("can't set route %q: %w", path, err)
+	}
+	router.routes[path] = &route
+	return nil
+}
+
+// Returns all the routes, sorted by pattern
+func (router *Router) Routes() []*Route {
+	routes := make([]*Route, 0, len(router.routes))
+	for _, r := range router.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Pattern < routes[j].Pattern
+	})
+	return routes
+}
+
+// Assigns the name to the route previously set for path
+func (router *Router) NameRoute(name string, path string) error {
+	route, ok := router.routes[path]
+	if !ok {
+		return fmt.Errorf("can't name route %q: %w", path, ErrRouteNotFound)
+	}
+
+	if named, ok := router.names[name]; ok && named != route {
+		return fmt.Errorf("route name %q already assigned to %q", name, named.Pattern)
+	}
+
+	if route.Name != "" {
+		delete(router.names, route.Name)
+	}
+	route.Name = name
+	router.names[name] = route
+	return nil
+}
+
+// Builds the url of the route with the given name
+func (router *Router) URL(name string, params map[string]string) (string, error) {
+	route, ok := router.names[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrNamedRouteNotFound, name)
+	}
+	return route.URL(params)
 }
 
-// Given the path it returns the assigned route from the radix tree
-func (router *Router) RouteForPath(ctx context.Context, path string) (context.Context, error, interface{}) {
+// Returns true if a route matches the path
+func (router *Router) HasRoute(path string) bool {
+	route, _ := router.tree.findRoute(path)
+	return route != nil
+}
+
+// Given the method and the path it returns the assigned route from the radix tree.
+// If the path matches a route that can't handle the method, a MethodNotAllowedError is returned
+func (router *Router) RouteForPath(ctx context.Context, method string, path string) (context.Context, error, interface{}) {
 	route, params := router.tree.findRoute(path)
 
 	if route == nil {
 		return ctx, ErrRouteNotFound, nil
 	}
 
+	handler := route.handler(method)
+	if handler == nil {
+		return ctx, MethodNotAllowedError{Allowed: route.Methods()}, nil
+	}
+
 	c := context.WithValue(ctx, RoutingParamsKey, params)
-	controller, c := route.Handler(c)
+	controller, c := handler(c)
 	return c, nil, controller
 }
@@ -2,6 +2,11 @@ package router
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -58,16 +63,16 @@ func TestFindRoute(t *testing.T) {
 			builder.WriteString(", ")
 		}
 
-		if mustFind[r] == route.Name {
+		if mustFind[r] == route.Pattern {
 			if count == 0 {
-				t.Logf("found route %s for request %s with no params", route.Name, r)
+				t.Logf("found route %s for request %s with no params", route.Pattern, r)
 				_ = builder.String()
 			} else {
-				t.Logf("found route %s for request %s with params %s", route.Name, r, builder.String())
+				t.Logf("found route %s for request %s with params %s", route.Pattern, r, builder.String())
 			}
 
 		} else {
-			t.Fatalf("should not find route %s for request %s", route.Name, r)
+			t.Fatalf("should not find route %s for request %s", route.Pattern, r)
 		}
 
 
@@ -76,12 +81,265 @@ func TestFindRoute(t *testing.T) {
 	for _, r := range mustFail {
 		route, _ := m.tree.findRoute(r)
 		if route != nil {
-			t.Fatalf("should not find route %s for url %s", route.Name, r)
+			t.Fatalf("should not find route %s for url %s", route.Pattern, r)
 		}
 		t.Logf("correctly did not find route %s", r)
 	}
 }
 
+func TestConstraints(t *testing.T) {
+	m := NewRouter()
+	m.SetRoute("/orders/new", nil)
+	m.SetRoute("/orders/:id<int>", nil)
+	m.SetRoute("/orders/:uuid<uuid>", nil)
+	m.SetRoute("/orders/:slug<[a-z-]+>", nil)
+	m.SetRoute("/items/:id<int>/detail", nil)
+	m.SetRoute("/items/:name/detail", nil)
+	m.SetRoute("/items/:name/reviews", nil)
+
+	mustFind := map[string]string{
+		"/orders/new":                                  "/orders/new",
+		"/orders/42":                                   "/orders/:id<int>",
+		"/orders/-42":                                  "/orders/:id<int>",
+		"/orders/0b5f7ff2-0e39-4ec4-b3ae-9c6b6c0a4b3d": "/orders/:uuid<uuid>",
+		"/orders/a-new-order":                          "/orders/:slug<[a-z-]+>",
+		"/items/42/detail":                             "/items/:id<int>/detail",
+		"/items/book/detail":                           "/items/:name/detail",
+		"/items/42/reviews":                            "/items/:name/reviews",
+	}
+
+	for r, expected := range mustFind {
+		route, params := m.tree.findRoute(r)
+		if route == nil {
+			t.Fatalf("couldn't find route %s", r)
+		}
+		if route.Pattern != expected {
+			t.Fatalf("found route %s instead of %s for request %s", route.Pattern, expected, r)
+		}
+		if len(params) != 1 {
+			if expected == "/orders/new" && len(params) == 0 {
+				continue
+			}
+			t.Fatalf("found params %v for request %s", params, r)
+		}
+	}
+
+	mustFail := []string{
+		"/orders/A1",
+		"/orders/4-2",
+		"/items/42/end",
+	}
+
+	for _, r := range mustFail {
+		if route, _ := m.tree.findRoute(r); route != nil {
+			t.Fatalf("should not find route %s for url %s", route.Pattern, r)
+		}
+	}
+
+	m.NameRoute("order", "/orders/:id<int>")
+	if _, err := m.URL("order", map[string]string{"id": "abc"}); err == nil {
+		t.Fatal("built url with a parameter not satisfying the constraint")
+	}
+}
+
+func TestWildcardParams(t *testing.T) {
+	m := NewRouter()
+	m.SetRoute("/files/:bucket/*path", nil)
+	m.SetRoute("/cms/*", nil)
+	m.SetRoute("/static/*dir/:file", nil)
+
+	requests := map[string]string{
+		"/files/images/2019/logo.png": "[{bucket images} {path 2019/logo.png}]",
+		"/files/images/":              "[{bucket images} {path }]",
+		"/cms/about/team":             "[{* about/team}]",
+		"/static/css/main.css":        "[{dir css} {file main.css}]",
+	}
+
+	for r, expected := range requests {
+		route, params := m.tree.findRoute(r)
+		if route == nil {
+			t.Fatalf("couldn't find route %s", r)
+		}
+		if found := fmt.Sprint(params); found != expected {
+			t.Fatalf("found params %s instead of %s for request %s", found, expected, r)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	m := NewRouter()
+	valid := []string{
+		"/:a",
+		"/:a/:b",
+		"/:id<int>",
+		"/files/*path",
+		"/files/*path/:name",
+	}
+
+	for _, r := range valid {
+		if err := m.SetRoute(r, nil); err != nil {
+			t.Fatalf("couldn't set route %s: %s", r, err)
+		}
+	}
+
+	if err := m.SetMethodRoute(http.MethodGet, "/:a", nil); err != nil {
+		t.Fatalf("couldn't set GET route on an existing route: %s", err)
+	}
+
+	conflicts := []struct {
+		method string
+		route  string
+	}{
+		{"", "/:a"},
+		{http.MethodGet, "/:a"},
+		{"", "/:b"},
+		{"", "/:a/:c"},
+		{"", "/:key<int>"},
+		{"", "/files/*rest"},
+		{"", "/:id<unterminated"},
+	}
+
+	for _, c := range conflicts {
+		err := m.SetMethodRoute(c.method, c.route, nil)
+		if err == nil {
+			t.Fatalf("no error setting conflicting route %s %s", c.method, c.route)
+		}
+		t.Logf("%s %s: %s", c.method, c.route, err)
+	}
+
+	if l := len(m.Routes()); l != len(valid) {
+		t.Fatalf("found %d routes instead of %d", l, len(valid))
+	}
+}
+
+func TestRejectedRoute(t *testing.T) {
+	m := NewRouter()
+	m.SetRoute("/x", nil)
+	m.SetRoute("/static/file", nil)
+	size := m.tree.size
+
+	rejected := []string{
+		"/:a/:b<int",
+		"/static/files/:name<unterminated",
+		"/stat/:name<unterminated",
+		"/x/*path/:id<int",
+	}
+
+	for _, r := range rejected {
+		if err := m.SetRoute(r, nil); err == nil {
+			t.Fatalf("no error setting malformed route %s", r)
+		}
+	}
+
+	if m.tree.size != size || m.tree.maxArgs != 0 {
+		t.Fatalf("rejected routes left %d nodes and %d max params in the tree", m.tree.size-size, m.tree.maxArgs)
+	}
+
+	for _, path := range []string{"/foo", "/foo/1", "/static/files/a", "/stat/a", "/x/y/1"} {
+		if _, err, _ := m.RouteForPath(context.Background(), http.MethodGet, path); err != ErrRouteNotFound {
+			t.Fatalf("%s: unexpected error %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"/x", "/static/file"} {
+		if !m.HasRoute(path) {
+			t.Fatalf("route %s lost after a rejected route", path)
+		}
+	}
+}
+
+func TestMethodRoute(t *testing.T) {
+	handler := func(name string) Handler {
+		return func(ctx context.Context) (interface{}, context.Context) {
+			return name, ctx
+		}
+	}
+
+	m := NewRouter()
+	m.SetMethodRoute(http.MethodGet, "/item/:id", handler("get"))
+	m.SetMethodRoute(http.MethodPut, "/item/:id", handler("put"))
+	m.SetRoute("/any", handler("any"))
+	m.SetMethodRoute(http.MethodPost, "/any", handler("post"))
+
+	mustServe := map[string]string{
+		http.MethodGet + " /item/3":  "get",
+		http.MethodHead + " /item/3": "get",
+		http.MethodPut + " /item/3":  "put",
+		http.MethodGet + " /any":     "any",
+		http.MethodPost + " /any":    "post",
+	}
+
+	for r, expected := range mustServe {
+		req := strings.SplitN(r, " ", 2)
+		_, err, c := m.RouteForPath(context.Background(), req[0], req[1])
+		if err != nil {
+			t.Fatalf("error routing %s: %s", r, err)
+		}
+		if c != expected {
+			t.Fatalf("request %s served by %s handler instead of %s", r, c, expected)
+		}
+	}
+
+	_, err, _ := m.RouteForPath(context.Background(), http.MethodDelete, "/item/3")
+	e, ok := err.(MethodNotAllowedError)
+	if !ok {
+		t.Fatalf("expected method not allowed error, got %v", err)
+	}
+
+	if allowed := strings.Join(e.Allowed, ", "); allowed != "GET, HEAD, PUT" {
+		t.Fatalf("wrong allowed methods %q", allowed)
+	}
+}
+
+func TestURL(t *testing.T) {
+	m := NewRouter()
+	m.SetRoute("/products/:id/reviews/:review", nil)
+	m.SetRoute("/files/*", nil)
+	m.SetRoute("/static", nil)
+
+	if err := m.NameRoute("review", "/products/:id/reviews/:review"); err != nil {
+		t.Fatal(err)
+	}
+	m.NameRoute("files", "/files/*")
+	m.NameRoute("static", "/static")
+
+	if err := m.NameRoute("missing", "/missing"); err == nil {
+		t.Fatal("named a route that doesn't exist")
+	}
+
+	if err := m.NameRoute("static", "/files/*"); err == nil {
+		t.Fatal("assigned the same name to two routes")
+	}
+
+	urls := []struct {
+		name   string
+		params map[string]string
+		url    string
+	}{
+		{"review", map[string]string{"id": "a b", "review": "3"}, "/products/a%20b/reviews/3"},
+		{"files", map[string]string{"*": "docs/my file.pdf"}, "/files/docs/my%20file.pdf"},
+		{"static", nil, "/static"},
+	}
+
+	for _, u := range urls {
+		url, err := m.URL(u.name, u.params)
+		if err != nil {
+			t.Fatalf("error building url for %s: %s", u.name, err)
+		}
+		if url != u.url {
+			t.Fatalf("built url %s for %s instead of %s", url, u.name, u.url)
+		}
+	}
+
+	if _, err := m.URL("review", map[string]string{"id": "3"}); err == nil {
+		t.Fatal("built url with missing parameter")
+	}
+
+	if _, err := m.URL("unknown", nil); !errors.Is(err, ErrNamedRouteNotFound) {
+		t.Fatalf("unexpected error for unknown route: %v", err)
+	}
+}
+
 func TestMaxParams(t *testing.T) {
 	m := NewRouter()
 	m.SetRoute("", nil)
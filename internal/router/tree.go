@@ -1,15 +1,19 @@
 package router
 
 import (
+	"fmt"
 	"strings"
 )
 
 // A specialized radix tree implementation to handle route matching.
 // heavily inspired by @https://github.com/armon/go-radix/blob/master/radix.go
-// a route is our leaf node, where route name is the key.
+// a route is our leaf node, where route pattern is the key.
 // Differently from a pure radix tree, on insertion all path segments are created if they do not exist
 // ex: inserting only the node at "/my/route/example" creates six nodes, separated by '/'
 // namely: "/", "my", "/", "route", "/", "example"
+// Parameters (":id", ":id<int>") and wildcards ("*") always span a whole segment and are kept apart from the
+// static children: on lookup static children are tested first, then parameters and finally wildcards,
+// backtracking to the next candidate whenever a path can't be matched.
 
 // An edge connects one node with another in a parent->child relation
 // The label is the byte connecting each node and it coincides with the first character
@@ -33,7 +37,7 @@ type node struct {
 	//prefix is the common prefix to ignore
 	prefix string
 
-	// sorted slice of edge
+	// sorted slice of edge, connecting the static children
 	edges edges
 
 	// parent of the node
@@ -42,16 +46,14 @@ type node struct {
 	// wildcard
 	wildcardChild *node
 
-	// param
-	paramChild *node
+	// parametric children. Constrained parameters come first, so that they are tested before the unconstrained one
+	paramChildren []*node
 
-	// true if the node is parametric or a wildcard
-	isParametric bool
-}
+	// name of the parameter captured by a parametric node
+	key string
 
-// returns true if the node has parametric children or wildcard
-func (n node) hasParametricChildren() bool {
-	return n.wildcardChild != nil || n.paramChild != nil
+	// constraint on the value of the parameter. If nil, any value is accepted
+	constraint *constraint
 }
 
 func (n *node) addEdge(edge edge) {
@@ -87,6 +89,11 @@ func (n node) isLeaf() bool {
 	return len(n.edges) == 0
 }
 
+// returns true if the node has any static, parametric or wildcard child
+func (n node) hasChildren() bool {
+	return len(n.edges) > 0 || len(n.paramChildren) > 0 || n.wildcardChild != nil
+}
+
 type tree struct {
 	root    *node
 	size    int
@@ -137,91 +144,181 @@ func splitSegments(url string) []string {
 	return segments
 }
 
-func (t *tree) insert(route *Route) {
-	n := t.addEdge(route)
-	// walk the tree and count all the path params
+// returns the length of the static part of the path, that is the part preceding the first parameter or wildcard
+func staticLen(path string) int {
+	for i := 0; i < len(path); i++ {
+		if (path[i] == paramChar || path[i] == wildcardChar) && (i == 0 || path[i-1] == '/') {
+			return i
+		}
+	}
+	return len(path)
+}
+
+// returns the length of the first segment of the path
+func segmentLen(path string) int {
+	if idx := strings.IndexByte(path, '/'); idx != -1 {
+		return idx
+	}
+	return len(path)
+}
+
+func (t *tree) insert(route *Route) error {
+	if _, err := t.addEdge(route); err != nil {
+		return err
+	}
+	// count all the path params
 	params := 0
-	for n.parent != nil {
-		if n.isParametric {
+	for _, segment := range strings.Split(route.Pattern, "/") {
+		if len(segment) > 0 && (segment[0] == paramChar || segment[0] == wildcardChar) {
 			params++
 		}
-		n = n.parent
 	}
 
 	if params > t.maxArgs {
 		t.maxArgs = params
 	}
+	return nil
+}
+
+// returns the parametric or wildcard child of the node for the given segment, creating it if needed.
+// Returns an error if the segment is ambiguous with an existing one, that is if they would match the same values
+// with different names
+func (t *tree) dynamicChild(parent *node, segment string, undo *[]func()) (*node, error) {
+	if segment[0] == wildcardChar {
+		if parent.wildcardChild == nil {
+			parent.wildcardChild = &node{prefix: segment, parent: parent, key: wildcardKey(segment)}
+			t.size++
+			*undo = append(*undo, func() {
+				parent.wildcardChild = nil
+				t.size--
+			})
+		}
+		if wild := parent.wildcardChild; wild.prefix != segment {
+			return nil, fmt.Errorf("%w: wildcard %q is ambiguous with %q", ErrRouteConflict, segment, wild.prefix)
+		}
+		return parent.wildcardChild, nil
+	}
+
+	for _, child := range parent.paramChildren {
+		if child.prefix == segment {
+			return child, nil
+		}
+	}
+
+	key, c, err := parseParameter(segment)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range parent.paramChildren {
+		if (c == nil && child.constraint == nil) || (c != nil && child.constraint != nil && c.expr == child.constraint.expr) {
+			return nil, fmt.Errorf("%w: parameter %q is ambiguous with %q", ErrRouteConflict, segment, child.prefix)
+		}
+	}
+
+	child := &node{prefix: segment, parent: parent, key: key, constraint: c}
+	t.size++
+
+	// keep the unconstrained parameters at the end of the children
+	idx := len(parent.paramChildren)
+	if c != nil {
+		for i, p := range parent.paramChildren {
+			if p.constraint == nil {
+				idx = i
+				break
+			}
+		}
+	}
+	parent.paramChildren = append(parent.paramChildren, nil)
+	copy(parent.paramChildren[idx+1:], parent.paramChildren[idx:])
+	parent.paramChildren[idx] = child
+	*undo = append(*undo, func() {
+		parent.paramChildren = append(parent.paramChildren[:idx], parent.paramChildren[idx+1:]...)
+		t.size--
+	})
+	return child, nil
 }
 
 // adds a new node or updates an existing one
-// returns true if the node has been updated
-func (t *tree) addEdge(route *Route) *node {
+// returns the node the route has been assigned to.
+// If the route can't be added, the nodes created for it are removed, leaving the tree as it was
+func (t *tree) addEdge(route *Route) (*node, error) {
+	var undo []func()
+	n, err := t.attach(route, &undo)
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+// walks the tree along the pattern of the route, creating the missing nodes, and assigns the route to the last one.
+// Each change to the tree is recorded in undo, so that it can be reverted
+func (t *tree) attach(route *Route, undo *[]func()) (*node, error) {
 
-	var parent *node
 	n := t.root
-	search := route.Name
+	search := route.Pattern
 
 	for {
 		if len(search) == 0 {
 			// we append the route at the end of the tree.
+			if n.route != nil && n.route != route {
+				return nil, fmt.Errorf("%w: %q is already set", ErrRouteConflict, n.route.Pattern)
+			}
 			n.route = route
+			return n, nil
+		}
 
-			// if we are not at the leaf, we increment the tree size
-			t.size++
-
-			return n
+		// parameters and wildcards always span a whole segment and are never split
+		if search[0] == paramChar || search[0] == wildcardChar {
+			l := segmentLen(search)
+			child, err := t.dynamicChild(n, search[:l], undo)
+			if err != nil {
+				return nil, err
+			}
+			n = child
+			search = search[l:]
+			continue
 		}
 
+		static := search[:staticLen(search)]
+
 		// look for the edge
-		parent = n
-		n = n.getEdge(search[0])
+		child := n.getEdge(static[0])
 		// there is no edge from the parent to the new node.
-		// we create a new edge and a new node, using the search as prefix
+		// we create a new edge and a new node for each segment of the static part
 		// and we connect it to the new node (parent)-----(new-node)
 		// or we have an empty tree
-		if n == nil {
-			segments := splitSegments(search)
-			l := len(segments)
-
-			for i := 0; i < l; i++ {
-				var r *Route
-				if i == l-1 {
-					r = route
-				}
-
-				segment := segments[i]
-				node := node{route: r, prefix: segment}
-				e := edge{
-					label: segment[0],
-					node:  &node,
-				}
-				switch segment[0] {
-				case paramChar:
-					parent.paramChild = &node
-					node.isParametric = true
-				case wildcardChar:
-					parent.wildcardChild = &node
-				}
-
-				parent.addEdge(e)
-
-				parent = &node
+		if child == nil {
+			for _, segment := range splitSegments(static) {
+				child = &node{prefix: segment}
+				n.addEdge(edge{label: segment[0], node: child})
+				parent := n
+				*undo = append(*undo, func() {
+					parent.edges = parent.edges[:len(parent.edges)-1]
+					t.size--
+				})
+				n = child
 				t.size++
 			}
-			return parent
+			search = search[len(static):]
+			continue
 		}
 
 		// we found an edge to attach the new node
 		// common is the idx of the divergent char
 		// i.e. "aab" and "aac" then common has value 2
-		wanted := longestPrefix(search, n.prefix)
+		wanted := longestPrefix(static, child.prefix)
 
 		// if the prefixes coincide in len
 		// we consume the search and continue the loop with the remaining slice.
 		// we have this case when ex.confronting /static with /static/enzo. In this case the common chars
 		// are equal to the node prefix (/static).
 		// We walk the node and look for a place to append the route following this path
-		if wanted == len(n.prefix) {
+		if wanted == len(child.prefix) {
+			n = child
 			search = search[wanted:]
 			continue
 		}
@@ -233,166 +330,101 @@ func (t *tree) addEdge(route *Route) *node {
 		// the new child has the prefix in common.
 		// ex. /static/carlo with /static/enzo -> the common route is /static/
 		// thus we create a new route-less node with prefix "/static/"
-		// child is the new transition node
-		child := &node{
-			prefix: search[:wanted],
-		}
-		parent.updateEdge(search[0], child)
-
-		// now that we split the nodes, we re-prepend the newly created node (created from the split)
-		// to the common part.
-		// ex. we are inserting "/static/enzo" and we find "/static/carlo"
-		// in this case we create a new node with prefix "/static/", we append the "carlo" to the "/static" node
-		// and we add "enzo" to the static node
-		// we must update the state of the wildcardChild, checking if any wildcard are left
-		e := edge{
-			label: n.prefix[wanted],
-			node:  n,
+		// and we re-append the old node, with all its children, to the new one
+		split := &node{
+			prefix: child.prefix[:wanted],
 		}
+		n.updateEdge(static[0], split)
 
-		n.prefix = n.prefix[wanted:]
-
-		switch e.label {
-		case paramChar:
-			child.paramChild = n
-			n.isParametric = true
-		case wildcardChar:
-			child.wildcardChild = n
-		}
+		prefix := child.prefix
+		child.prefix = child.prefix[wanted:]
+		split.addEdge(edge{label: child.prefix[0], node: child})
 
-		child.addEdge(e)
+		parent, old := n, child
+		*undo = append(*undo, func() {
+			old.prefix = prefix
+			parent.updateEdge(prefix[0], old)
+			t.size--
+		})
 
+		n = split
 		search = search[wanted:]
-		// If the new key was the same of the parent
-		// we assign the route to the node.
-		if len(search) == 0 {
-			child.route = route
-			return child
-		}
-
-		// if the prefix contains two or more segments of the url, we break it into multiple
-		// empty nodes
-		segments := splitSegments(search)
-		l := len(segments)
-
-		for i := 0; i < l; i++ {
-			var r *Route
-			if i == l-1 {
-				r = route
-			}
-			segment := segments[i]
-			node := node{route: r, prefix: segment}
-			e = edge{
-				label: segment[0],
-				node:  &node,
-			}
-			switch e.label {
-			case paramChar:
-				child.paramChild = &node
-				node.isParametric = true
-			case wildcardChar:
-				child.wildcardChild = &node
-			}
-
-			child.addEdge(e)
-
-			child = &node
-			t.size++
-		}
-
-		return child
 	}
 }
 
 // Finds the requested route
 func (t tree) findRoute(wanted string) (*Route, Params) {
-	n := t.root
-
-	search := wanted
 	// maps all params gathered along the path
 	// avoid the use of append
 	var params Params
-	pcount := 0
 
 	if t.maxArgs > 0 {
 		params = make(Params, t.maxArgs)
 	}
 
-	// lp is the last parametric node we encountered
-	var lp *node
-
-	var wild *node
-
-	// freeze index in case of parameter
-	tag := 0
-
-	for {
-
-		var edge byte
+	route, pcount := t.root.match(wanted, params, 0)
+	if route == nil {
+		return nil, nil
+	}
+	return route, params[:pcount]
+}
 
-		// we traversed all the trie
-		// return the route at the node
-		slen := len(search)
+// Matches the search against the subtree of the node, whose prefix has already been consumed.
+// Static children are tested first, then the parametric ones and finally the wildcard.
+// If a path fails to match, the search backtracks to the next candidate.
+// Returns the route found, if any, and the number of params gathered
+func (n *node) match(search string, params Params, pcount int) (*Route, int) {
+	if len(search) == 0 && n.route != nil {
+		return n.route, pcount
+	}
 
-		if slen == 0 {
-			if n.route == nil && lp != nil {
-				n = lp.paramChild
-			} else {
-				return n.route, params[:pcount]
+	if len(search) > 0 {
+		if child := n.getEdge(search[0]); child != nil && strings.HasPrefix(search, child.prefix) {
+			if route, count := child.match(search[len(child.prefix):], params, pcount); route != nil {
+				return route, count
 			}
-		} else {
-			edge = search[0]
 		}
+	}
 
-		n = n.getEdge(edge)
+	l := segmentLen(search)
 
-		if n != nil && n.hasParametricChildren() {
-			lp = n
-			if w := lp.wildcardChild; w != nil {
-				wild = w
-			}
-			// freeze the param value to the moment we find a parameter, in case we need to go back
-			tag = len(wanted) - slen + 1
-		}
-
-		// we arrived at the end of the selected path
-		if n == nil || slen < len(n.prefix) || search[0:len(n.prefix)] != n.prefix {
+	// the params are sized after the routes with most parameters: a node can't capture beyond them
+	if pcount >= len(params) {
+		return nil, pcount
+	}
 
-			// there's no valid parametric node on the way, we can break the loop, the search is over
-			if lp == nil {
-				break
+	// a parameter matches a whole, non empty, segment
+	if l > 0 {
+		segment := search[:l]
+		for _, child := range n.paramChildren {
+			if child.constraint != nil && !child.constraint.match(segment) {
+				continue
 			}
-
-			// else, we must reconsider our path by walking a parametric route: backtracking
-			// we couldn't find a match, so we go back to the last parametric node we found on the way.
-			// If such a node exists, we walk the parametric route looking for the correct match.
-
-			until := strings.IndexByte(wanted[tag:], '/')
-
-			// we are at the end of the string,
-			if until == -1 {
-				until = len(wanted) - tag
+			params[pcount].Key = child.key
+			params[pcount].Value = segment
+			if route, count := child.match(search[l:], params, pcount+1); route != nil {
+				return route, count
 			}
+		}
+	}
 
-			if n = lp.paramChild; n != nil {
-				params[pcount].Key = n.prefix[1:]
-				params[pcount].Value = wanted[tag : tag+until]
-				pcount++
-			} else {
-				n = lp.wildcardChild
-			}
+	if wild := n.wildcardChild; wild != nil {
+		params[pcount].Key = wild.key
 
-			lp = nil
-			search = wanted[tag+until:]
-			continue
+		// a wildcard followed by other segments matches a single segment
+		if l > 0 && wild.hasChildren() {
+			params[pcount].Value = search[:l]
+			if route, count := wild.match(search[l:], params, pcount+1); route != nil {
+				return route, count
+			}
 		}
 
-		search = search[len(n.prefix):]
-	}
-
-	if wild != nil {
-		return wild.route, nil
+		// a wildcard at the end of the route matches the rest of the path
+		if wild.route != nil {
+			params[pcount].Value = search
+			return wild.route, pcount + 1
+		}
 	}
 
-	return nil, nil
+	return nil, pcount
 }
@@ -0,0 +1,69 @@
+package flamel
+
+import (
+	"context"
+	"net/http"
+)
+
+// ProcessFunc executes the logic of a request. Controller.Process is a ProcessFunc
+type ProcessFunc func(ctx context.Context, out *ResponseOutput) HttpResponse
+
+// A Middleware wraps the execution of a controller.
+// The middleware can modify the context and the output before calling next, observe or replace the HttpResponse
+// returned by next, or abort the request by returning its own response without calling next at all.
+type Middleware func(next ProcessFunc) ProcessFunc
+
+const keyRouteMiddlewares = "__flamel_route_middlewares__"
+
+// Adds middlewares wrapping every controller processed by the instance.
+// Middlewares are executed in the order they are added, before any route middleware
+func (fl *flamel) Use(middlewares ...Middleware) {
+	fl.middlewares = append(fl.middlewares, middlewares...)
+}
+
+// Assigns middlewares to the route being resolved. Routers call it before returning the controller
+func withRouteMiddlewares(ctx context.Context, middlewares []Middleware) context.Context {
+	if len(middlewares) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, keyRouteMiddlewares, append(routeMiddlewares(ctx), middlewares...))
+}
+
+func routeMiddlewares(ctx context.Context) []Middleware {
+	if middlewares, ok := ctx.Value(keyRouteMiddlewares).([]Middleware); ok {
+		return middlewares[:len(middlewares):len(middlewares)]
+	}
+	return nil
+}
+
+// wraps process with the given middlewares, the first middleware being the outermost one
+func chain(process ProcessFunc, middlewares []Middleware) ProcessFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		process = middlewares[i](process)
+	}
+	return process
+}
+
+// runs the controller through the instance middlewares and the ones assigned to the route.
+// If the controller or a middleware panics, the output is reset and the response is rendered by the PanicHandler
+func (fl *flamel) process(ctx context.Context, controller Controller, out *ResponseOutput) (response HttpResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			*out = newResponseOutput()
+			response = fl.Config.PanicHandler(ctx, newPanicError(r), out)
+		}
+	}()
+
+	routeMws := routeMiddlewares(ctx)
+	if len(routeMws) == 0 && len(fl.middlewares) == 0 {
+		// spares the allocation of the chain
+		return controller.Process(ctx, out)
+	}
+
+	process := chain(controller.Process, routeMws)
+	process = chain(process, fl.middlewares)
+	return process(ctx, out)
+}
@@ -0,0 +1,103 @@
+package flamel
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+// A DataRenderer returns the renderer of data in a specific representation
+type DataRenderer func(data interface{}) Renderer
+
+// Renders data as JSON
+func RenderJSON(data interface{}) Renderer {
+	return &JSONRenderer{Data: data}
+}
+
+// Renders data as plain text, formatted as fmt.Sprint does
+func RenderText(data interface{}) Renderer {
+	return &plainTextRenderer{TextRenderer{Data: fmt.Sprint(data)}}
+}
+
+// Renders data with the named template
+func RenderTemplate(t *template.Template, name string) DataRenderer {
+	return func(data interface{}) Renderer {
+		return &TemplateRenderer{Template: t, TemplateName: name, Data: data}
+	}
+}
+
+// a TextRenderer declaring its content type
+type plainTextRenderer struct {
+	TextRenderer
+}
+
+func (renderer *plainTextRenderer) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	return renderer.TextRenderer.Render(w)
+}
+
+// Renders Data with the renderer registered for the content negotiated with the client, i.e.:
+//
+//	out.Renderer = &flamel.NegotiatedRenderer{
+//		Data: product,
+//		Renderers: map[string]flamel.DataRenderer{
+//			"text/html":        flamel.RenderTemplate(templates, "product.html"),
+//			"application/json": flamel.RenderJSON,
+//		},
+//	}
+//
+// The content types must be offered by the ContentOfferer of the controller, or by the default one.
+// If no renderer is registered for the negotiated content, Data is rendered as Default.
+// The response is 406 Not Acceptable if there's no Default, or if a strict ContentOfferer found no acceptable offer
+type NegotiatedRenderer struct {
+	Data interface{}
+	// renderers by content type, i.e. "application/json"
+	Renderers map[string]DataRenderer
+	// the content type rendered when the negotiated one has no renderer
+	Default string
+}
+
+// returns the renderer of the negotiated content
+func (renderer *NegotiatedRenderer) renderer(ctx context.Context) Renderer {
+	negotiated := ""
+	if ins, ok := ctx.Value(KeyRequestInputs).(RequestInputs); ok {
+		negotiated = ins[KeyNegotiatedContent].Value()
+	} else {
+		negotiated = renderer.Default
+	}
+
+	// an empty negotiation means that the client accepts none of the offers
+	if negotiated == "" {
+		return &notAcceptableRenderer{}
+	}
+
+	r, ok := renderer.Renderers[negotiated]
+	if !ok {
+		r, ok = renderer.Renderers[renderer.Default]
+	}
+	if !ok {
+		return &notAcceptableRenderer{}
+	}
+	return r(renderer.Data)
+}
+
+func (renderer *NegotiatedRenderer) Render(w http.ResponseWriter) error {
+	return renderer.RenderContext(context.Background(), w)
+}
+
+func (renderer *NegotiatedRenderer) RenderContext(ctx context.Context, w http.ResponseWriter) error {
+	w.Header().Add("Vary", "Accept")
+	return render(ctx, renderer.renderer(ctx), w)
+}
+
+// responds 406 Not Acceptable, whatever the status returned by the controller
+type notAcceptableRenderer struct{}
+
+func (renderer *notAcceptableRenderer) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusNotAcceptable)
+	_, err := io.WriteString(w, http.StatusText(http.StatusNotAcceptable))
+	return err
+}
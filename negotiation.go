@@ -10,6 +10,26 @@ type ContentOfferer interface {
 	Offers() []string
 }
 
+// A StrictContentOfferer doesn't fall back to its default offer when the client accepts none of its offers:
+// the negotiated content is empty and negotiated renderers respond 406 Not Acceptable
+type StrictContentOfferer interface {
+	ContentOfferer
+	Strict() bool
+}
+
+type strictContentOfferer struct {
+	ContentOfferer
+}
+
+func (co strictContentOfferer) Strict() bool {
+	return true
+}
+
+// Returns a strict version of the offerer
+func Strict(offerer ContentOfferer) ContentOfferer {
+	return strictContentOfferer{offerer}
+}
+
 type defaultContentOfferer struct{}
 
 func (co defaultContentOfferer) DefaultOffer() string {
@@ -17,10 +37,10 @@ func (co defaultContentOfferer) DefaultOffer() string {
 }
 
 func (co defaultContentOfferer) Offers() []string {
-	return []string{"text/html", "application/json"}
+	return []string{"text/html", "application/json", "application/problem+json", mimeXML, mimeCSV, mimeMessagePack}
 }
 
-func (f flamel) negotiatedContent(r *http.Request, offerer ContentOfferer) string {
+func (f *flamel) negotiatedContent(r *http.Request, offerer ContentOfferer) string {
 	// parse the accept header
 	best := offerer.DefaultOffer()
 	if accept, ok := r.Header["Accept"]; ok {
@@ -58,6 +78,9 @@ func (f flamel) negotiatedContent(r *http.Request, offerer ContentOfferer) strin
 			}
 		}
 
+		if strict, ok := offerer.(StrictContentOfferer); ok && strict.Strict() && maxQ < 0 {
+			return ""
+		}
 	}
 
 	return best
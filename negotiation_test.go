@@ -15,9 +15,14 @@ func TestNegotiation_Parse(t *testing.T) {
 	req.Header.Add("Accept", "text/csv")
 	det := fl.negotiatedContent(req, defaultContentOfferer{})
 
-	if det != "text/html" {
+	if det != "text/csv" {
 		t.Fail()
 	}
+
+	req.Header.Set("Accept", "image/png")
+	if det := fl.negotiatedContent(req, defaultContentOfferer{}); det != "text/html" {
+		t.Fatalf("unacceptable requests should receive the default offer, received %q", det)
+	}
 }
 
 func BenchmarkNegotiation(b *testing.B) {
@@ -32,3 +37,23 @@ func BenchmarkNegotiation(b *testing.B) {
 		fl.negotiatedContent(req, defaultContentOfferer{})
 	}
 }
+
+func TestNegotiation_Strict(t *testing.T) {
+	fl := flamel{}
+	offerer := Strict(defaultContentOfferer{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if det := fl.negotiatedContent(req, offerer); det != "text/html" {
+		t.Fatalf("requests without Accept header should receive the default offer, received %q", det)
+	}
+
+	req.Header.Add("Accept", "image/png")
+	if det := fl.negotiatedContent(req, offerer); det != "" {
+		t.Fatalf("no offer should be acceptable, received %q", det)
+	}
+
+	req.Header.Set("Accept", "image/png, application/*;q=0.5")
+	if det := fl.negotiatedContent(req, offerer); det != "application/json" {
+		t.Fatalf("unexpected offer %q", det)
+	}
+}
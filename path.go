@@ -0,0 +1,85 @@
+package flamel
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// PathPolicy defines how flamel treats request paths that are not in their canonical form,
+// i.e. "/static/" for a route set as "/static", "/a//b" or "/a/../b"
+type PathPolicy int
+
+const (
+	// paths are routed as they are received
+	PathStrict PathPolicy = iota
+	// non canonical paths are redirected to their canonical form:
+	// 301 Moved Permanently for GET and HEAD requests, 308 Permanent Redirect for any other method
+	PathRedirect
+	// non canonical paths are routed as if they were in their canonical form, without redirecting
+	PathLenient
+)
+
+// cleans the path by removing double slashes and resolving dot segments, keeping the trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	if p[0] != '/' {
+		p = "/" + p
+	}
+
+	clean := path.Clean(p)
+	if clean != "/" && strings.HasSuffix(p, "/") {
+		clean += "/"
+	}
+	return clean
+}
+
+// Returns the canonical form of the path and true if it differs from the path.
+// The canonical path is the cleaned path, with or without the trailing slash depending on the route it matches.
+// If no route matches neither form, the path is returned as it is
+func (fl *flamel) canonicalPath(p string) (string, bool) {
+	clean := cleanPath(p)
+	if fl.HasRoute(clean) {
+		return clean, clean != p
+	}
+
+	alt := clean + "/"
+	if strings.HasSuffix(clean, "/") {
+		alt = clean[:len(clean)-1]
+	}
+
+	if alt != "" && fl.HasRoute(alt) {
+		return alt, true
+	}
+
+	return p, false
+}
+
+// Returns the prefix removed from the path of the request before it reached the instance,
+// i.e. "/admin" for an instance mounted with http.StripPrefix("/admin", fl)
+func strippedPrefix(req *http.Request) string {
+	if req.RequestURI == "" {
+		return ""
+	}
+
+	original, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil || !strings.HasSuffix(original.Path, req.URL.Path) {
+		return ""
+	}
+	return original.Path[:len(original.Path)-len(req.URL.Path)]
+}
+
+// redirects the request to the given path, preserving the query string and the prefix the instance is mounted under
+func redirectToPath(w http.ResponseWriter, req *http.Request, p string) {
+	status := http.StatusPermanentRedirect
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+
+	location := url.URL{Path: strippedPrefix(req) + p, RawQuery: req.URL.RawQuery}
+	http.Redirect(w, req, location.String(), status)
+}
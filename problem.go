@@ -0,0 +1,189 @@
+package flamel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+const (
+	mimeProblemJSON = "application/problem+json"
+	mimeJSON        = "application/json"
+	mimeHTML        = "text/html"
+)
+
+// A Problem details an error of an http API, as defined by RFC 7807
+type Problem struct {
+	// URI reference identifying the problem type. If empty, "about:blank" is assumed
+	Type string
+	// short summary of the problem type
+	Title string
+	// the http status of the response
+	Status int
+	// explanation specific to this occurrence of the problem
+	Detail string
+	// URI reference identifying this occurrence of the problem. Defaults to the request url
+	Instance string
+	// additional members of the problem document
+	Extensions map[string]interface{}
+}
+
+// Marshals the problem as a flat JSON object, extensions included
+func (p Problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+
+	if p.Type != "" {
+		members["type"] = p.Type
+	}
+	if p.Title != "" {
+		members["title"] = p.Title
+	}
+	if p.Status != 0 {
+		members["status"] = p.Status
+	}
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		members["instance"] = p.Instance
+	}
+	return json.Marshal(members)
+}
+
+// An HTTPError is an error carrying the status of the response it should produce.
+// Controllers can return it through ResponseOutput.RenderError, so that status and body of errors are consistent
+type HTTPError struct {
+	Status int
+	// defaults to the text of the status
+	Title  string
+	Detail string
+	// URI reference identifying the error type
+	Type       string
+	Extensions map[string]interface{}
+	// the cause of the error, if any. It is never disclosed to the client
+	Err error
+}
+
+func NewHTTPError(status int, detail string) *HTTPError {
+	return &HTTPError{Status: status, Detail: detail}
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	if e.Detail != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Detail)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the problem describing the error
+func (e *HTTPError) Problem() Problem {
+	title := e.Title
+	if title == "" {
+		title = http.StatusText(e.Status)
+	}
+	return Problem{Type: e.Type, Title: title, Status: e.Status, Detail: e.Detail, Extensions: e.Extensions}
+}
+
+// Returns the status of the response for the given error:
+// the status of an HTTPError or of a PanicError, 404 and 405 for routing errors and 500 for any other error
+func errorStatus(err error) int {
+	var httpErr *HTTPError
+	var panicErr *PanicError
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr.Status
+	case errors.As(err, &panicErr):
+		return panicErr.Status
+	case errors.Is(err, ErrRouteNotFound):
+		return http.StatusNotFound
+	}
+
+	if _, ok := err.(MethodNotAllowedError); ok {
+		return http.StatusMethodNotAllowed
+	}
+	return http.StatusInternalServerError
+}
+
+// Returns the problem describing the error.
+// Only HTTPErrors disclose their details: any other error is described by its status only
+func problemFor(err error) Problem {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Problem()
+	}
+	status := errorStatus(err)
+	return Problem{Title: http.StatusText(status), Status: status}
+}
+
+// Renders the error as a problem document and returns the response with the status of the error.
+// If err is, or wraps, an *HTTPError its status and details are used, otherwise the response is a 500 Internal Server Error
+func (out *ResponseOutput) RenderError(err error) HttpResponse {
+	problem := problemFor(err)
+	out.Renderer = &ProblemRenderer{Data: problem}
+	return HttpResponse{Status: problem.Status}
+}
+
+// An ErrorHandler that renders any error as a problem document, with the status of the error.
+// It can be used for any of the error handlers of the Config
+func ProblemHandler(ctx context.Context, err error, out *ResponseOutput) HttpResponse {
+	return out.RenderError(err)
+}
+
+var problemTemplate = template.Must(template.New("problem").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Detail}}<p>{{.Detail}}</p>{{end}}
+</body>
+</html>
+`))
+
+// Renders a problem document.
+// The representation depends on the negotiated content: an HTML page for "text/html",
+// a JSON document served as "application/json" for "application/json", and "application/problem+json" otherwise
+type ProblemRenderer struct {
+	Data Problem
+}
+
+func (renderer *ProblemRenderer) Render(w http.ResponseWriter) error {
+	return renderer.RenderContext(context.Background(), w)
+}
+
+func (renderer *ProblemRenderer) RenderContext(ctx context.Context, w http.ResponseWriter) error {
+	problem := renderer.Data
+	negotiated := ""
+	if ins, ok := ctx.Value(KeyRequestInputs).(RequestInputs); ok {
+		negotiated = ins[KeyNegotiatedContent].Value()
+		if problem.Instance == "" {
+			problem.Instance = ins[KeyRequestURL].Value()
+		}
+	}
+
+	// the representation depends on the Accept header of the request
+	w.Header().Add("Vary", "Accept")
+	switch negotiated {
+	case mimeHTML:
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		return problemTemplate.Execute(w, problem)
+	case mimeJSON:
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	default:
+		w.Header().Set("Content-Type", mimeProblemJSON)
+	}
+	return json.NewEncoder(w).Encode(problem)
+}
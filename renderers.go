@@ -2,6 +2,7 @@ package flamel
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"google.golang.org/appengine"
@@ -9,12 +10,93 @@ import (
 	"html/template"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// the capacity of the largest buffer kept in the pool.
+// Bigger buffers are left to the garbage collector, so that a single huge page doesn't pin its memory
+const maxPooledBufferSize = 64 << 10
+
+// writers buffering the output of the renderers. They are shared by all flamel instances
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bufferedWriter{header: make(http.Header)}
+	},
+}
+
+// A bufferedWriter collects the output of a renderer, headers included, so that it can be inspected before being sent
+// and discarded if the renderer fails
+type bufferedWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func getBufferedWriter() *bufferedWriter {
+	return bufferPool.Get().(*bufferedWriter)
+}
+
+func putBufferedWriter(w *bufferedWriter) {
+	if w.buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	w.buf.Reset()
+	w.status = 0
+	for k := range w.header {
+		delete(w.header, k)
+	}
+	bufferPool.Put(w)
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// avoids the conversion of the strings written by the renderers, i.e. with io.WriteString
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.buf.WriteString(s)
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// copies the headers set by the renderer to the response
+func (w *bufferedWriter) copyHeader(dst http.Header) {
+	for k, v := range w.header {
+		dst[k] = v
+	}
+}
+
+// reports whether the renderer produces its whole output at once, so that flamel can buffer it
+// and respond with a clean error if rendering fails
+func isBuffered(renderer Renderer) bool {
+	switch renderer.(type) {
+	case *TemplateRenderer, *JSONRenderer, *TextRenderer, *ErrorRenderer, *ProblemRenderer, *plainTextRenderer,
+		*XMLRenderer, *CSVRenderer, *MessagePackRenderer:
+		return true
+	}
+	return false
+}
+
 type Renderer interface {
 	Render(w http.ResponseWriter) error
 }
 
+// A ContextRenderer needs the request context to produce its output, i.e. to read the negotiated content.
+// flamel invokes RenderContext instead of Render
+type ContextRenderer interface {
+	Renderer
+	RenderContext(ctx context.Context, w http.ResponseWriter) error
+}
+
 // Renders a GO HTML template
 type TemplateRenderer struct {
 	Template     *template.Template
@@ -22,15 +104,9 @@ type TemplateRenderer struct {
 	Data         interface{}
 }
 
+// The output is buffered by flamel, so that a failing template results in an error response instead of a truncated page
 func (renderer *TemplateRenderer) Render(w http.ResponseWriter) error {
-	buf := instance.bufferPool.Get().(bytes.Buffer)
-	defer instance.bufferPool.Put(buf)
-	err := renderer.Template.ExecuteTemplate(&buf, renderer.TemplateName, renderer.Data)
-	if err != nil {
-		return err
-	}
-	_, err = buf.WriteTo(w)
-	return err
+	return renderer.Template.ExecuteTemplate(w, renderer.TemplateName, renderer.Data)
 }
 
 // Returns the data as JSON object(s)
@@ -68,6 +144,7 @@ type ErrorRenderer struct {
 }
 
 func (renderer *ErrorRenderer) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 	_, err := io.WriteString(w, renderer.Data.Error())
 	return err
 }
@@ -80,12 +157,55 @@ type DownloadRenderer struct {
 }
 
 func (renderer *DownloadRenderer) Render(w http.ResponseWriter) error {
+	return renderer.RenderContext(context.Background(), w)
+}
+
+// Sends the file, honoring the Range and If-Range headers of the request
+func (renderer *DownloadRenderer) RenderContext(ctx context.Context, w http.ResponseWriter) error {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", renderer.FileName))
 	if renderer.Mime == "" {
 		w.Header().Set("Content-Type", "application/octet-stream; charset=UTF-8")
 	} else {
 		w.Header().Set("Content-Type", fmt.Sprintf("%s; charset=%s", renderer.Mime, renderer.Encoding))
 	}
-	_, err := w.Write(renderer.Data)
-	return err
+	return serveContent(ctx, w, renderer.FileName, time.Time{}, bytes.NewReader(renderer.Data))
+}
+
+// Sends the content read from Data, honoring the Range and If-Range headers of the request,
+// so that downloads can be resumed and media can be seeked
+type FileRenderer struct {
+	// defaults to the type detected from the extension of FileName or from the content
+	Mime string
+	// if set, the file is sent as an attachment with this name
+	FileName string
+	// the modification time of the file, sent as Last-Modified and used to validate If-Range
+	ModTime time.Time
+	Data    io.ReadSeeker
+}
+
+func (renderer *FileRenderer) Render(w http.ResponseWriter) error {
+	return renderer.RenderContext(context.Background(), w)
+}
+
+func (renderer *FileRenderer) RenderContext(ctx context.Context, w http.ResponseWriter) error {
+	if renderer.FileName != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", renderer.FileName))
+	}
+	if renderer.Mime != "" {
+		w.Header().Set("Content-Type", renderer.Mime)
+	}
+	return serveContent(ctx, w, renderer.FileName, renderer.ModTime, renderer.Data)
+}
+
+// serves the content as http.ServeContent does, answering range requests with 206 Partial Content,
+// multipart/byteranges for multiple ranges and 416 Range Not Satisfiable.
+// Without a request in the context the whole content is sent
+func serveContent(ctx context.Context, w http.ResponseWriter, name string, modTime time.Time, content io.ReadSeeker) error {
+	req, ok := ctx.Value(keyRequest).(*http.Request)
+	if !ok {
+		_, err := io.Copy(w, content)
+		return err
+	}
+	http.ServeContent(w, req, name, modTime, content)
+	return nil
 }
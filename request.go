@@ -136,6 +136,9 @@ func (ins RequestInputs) MustString(key string) string {
 
 // generic response
 
+// The response of a controller. Status drives the status code of the response, 200 OK if not set.
+// Responses with status 204 No Content and 304 Not Modified, as well as responses to HEAD requests, have no body.
+// Location is the target of 3xx redirects
 type HttpResponse struct {
 	Status   int
 	Location string
@@ -145,19 +148,56 @@ type HttpResponse struct {
 
 type ResponseOutput struct {
 	cookies  []*http.Cookie
-	headers  map[string]string
+	headers  http.Header
 	Renderer Renderer
+	// validators of the response
+	etag         string
+	lastModified time.Time
 }
 
 func newResponseOutput() ResponseOutput {
 	out := ResponseOutput{}
-	out.headers = make(map[string]string)
 	out.Renderer = &TextRenderer{Data: ""}
 	return out
 }
 
+// Sets the header to the value, replacing any value already added. Same as SetHeader
 func (out *ResponseOutput) AddHeader(key string, value string) {
-	out.headers[key] = value
+	out.Header().Set(key, value)
+}
+
+// Sets the header to the value, replacing any value already added
+func (out *ResponseOutput) SetHeader(key string, value string) {
+	out.Header().Set(key, value)
+}
+
+// Appends the value to the header, keeping the values already added, i.e. for Link or Vary
+func (out *ResponseOutput) AppendHeader(key string, value string) {
+	out.Header().Add(key, value)
+}
+
+func (out *ResponseOutput) RemoveHeader(key string) {
+	out.headers.Del(key)
+}
+
+// Returns the headers of the response
+func (out *ResponseOutput) Header() http.Header {
+	// allocated on demand, since most responses don't set any header
+	if out.headers == nil {
+		out.headers = make(http.Header)
+	}
+	return out.headers
+}
+
+// sets the cookies and the headers of the output on the response
+func (out *ResponseOutput) writeHeader(w http.ResponseWriter) {
+	for _, v := range out.cookies {
+		http.SetCookie(w, v)
+	}
+
+	for k, v := range out.headers {
+		w.Header()[k] = v
+	}
 }
 
 func (out *ResponseOutput) AddCookie(cookie http.Cookie) {
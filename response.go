@@ -0,0 +1,87 @@
+package flamel
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// A responseWriter defers writing the status of the response until the renderer writes the body,
+// so that renderers can still set headers, or override the status, i.e. with 206 Partial Content.
+// The body of responses that can't have one (204, 304 and HEAD requests) is discarded
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	head        bool
+	bodyless    bool
+}
+
+func newResponseWriter(w http.ResponseWriter, req *http.Request, status int) *responseWriter {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &responseWriter{ResponseWriter: w, status: status, head: req.Method == http.MethodHead}
+}
+
+// reports whether a response with the given status can't have a body
+func bodylessStatus(status int) bool {
+	return (status >= 100 && status < 200) || status == http.StatusNoContent || status == http.StatusNotModified
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.bodyless = w.head || bodylessStatus(status)
+
+	if status == http.StatusNoContent {
+		h := w.Header()
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(w.status)
+	}
+	if w.bodyless {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// writes the status if the renderer didn't write anything
+func (w *responseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(w.status)
+	}
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(w.status)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	w.wroteHeader = true
+	return h.Hijack()
+}
+
+// Returns the original writer, so that http.ResponseController can reach it
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
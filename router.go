@@ -3,27 +3,93 @@ package flamel
 import (
 	"context"
 	"decodica.com/flamel/internal/router"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
 )
 
+const keyRouter = "__flamel_router__"
+
 type Router interface {
-	SetRoute(url string, handler func(ctx context.Context) Controller, authenticator Authenticator)
+	// Assigns the handler to the url. Middlewares wrap the execution of the controller returned by the handler
+	// Returns an error wrapping ErrRouteConflict if the url is already set or it is ambiguous with an existing route
+	SetRoute(url string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error
+
+	// Utility method. Calls @SetRoute on each element of @urls, stopping at the first error
+	SetRoutes(urls []string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error
+
+	// Assigns the handler to the url for the given http method only.
+	// Routes set for the GET method also serve HEAD requests, unless a HEAD route is set for the same url
+	SetMethodRoute(method string, url string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error
+
+	// Returns a router whose routes share the given prefix.
+	// Routes set on the group without an authenticator inherit the group authenticator, and the group middlewares
+	// wrap the route middlewares. Groups can be nested.
+	Group(prefix string, authenticator Authenticator, middlewares ...Middleware) Router
+
+	// Assigns a logical name to the route set for the url, i.e. "product.detail"
+	NameRoute(name string, url string) error
+
+	// Builds the url of the named route, replacing its parameters with the given values
+	URLFor(name string, params map[string]string) (string, error)
+
+	// Lists the routes set on the router
+	Routes() []RouteInfo
+
+	// Returns true if a route matches the path, whatever its method. No handler is invoked
+	HasRoute(path string) bool
+
+	// Returns the controller for the given method and path.
+	// If no route matches the path ErrRouteNotFound is returned.
+	// If the path matches but the route can't handle the method a MethodNotAllowedError is returned.
+	RouteForPath(ctx context.Context, method string, path string) (context.Context, error, Controller)
+}
 
-	// Utility method. Calls @SetRoute on each element of @urls
-	SetRoutes(urls []string, handler func(ctx context.Context) Controller, authenticator Authenticator)
+// Returned by the router when no route matches the requested path
+var ErrRouteNotFound = router.ErrRouteNotFound
 
-	RouteForPath(ctx context.Context, path string) (context.Context, error, Controller)
+// Returned by the router when no route has the requested name
+var ErrNamedRouteNotFound = router.ErrNamedRouteNotFound
+
+// Returned by the router when a route is already set or it is ambiguous with an existing route,
+// i.e. "/:a" and "/:b"
+var ErrRouteConflict = router.ErrRouteConflict
+
+// Returned by the router when the requested path is matched by a route that doesn't handle the request method.
+// Allowed lists the methods handled by the route
+type MethodNotAllowedError = router.MethodNotAllowedError
+
+// Describes a route set on the router
+type RouteInfo struct {
+	// the url pattern of the route
+	Pattern string
+	// the method the route is set for. It is empty if the route handles any method
+	Method string
+	// the name of the route, if any
+	Name string
+	// the type of the authenticator of the route, i.e. "*auth.AdminAuthenticator". It is empty if the route has none
+	Authenticator string
 }
 
 type DefaultRouter struct {
 	router.Router
+	// if true, setting a route that conflicts with an existing one panics instead of returning the error
+	Strict bool
+	// authenticator types of the routes, by method and pattern
+	authenticators map[string]string
 }
 
 func NewDefaultRouter() *DefaultRouter {
 	dr := DefaultRouter{}
 	dr.Router = router.NewRouter()
+	dr.authenticators = make(map[string]string)
 	return &dr
 }
 
+// Returns the values captured by the route parameters.
+// Wildcards capture the matched part of the path under their name, i.e. "path" for "/files/*path",
+// or under "*" if anonymous.
 func RoutingParams(ctx context.Context) RequestInputs {
 	if params, ok := ctx.Value(router.RoutingParamsKey).(router.Params); ok {
 		inputs := make(RequestInputs, len(params))
@@ -37,25 +103,204 @@ func RoutingParams(ctx context.Context) RequestInputs {
 	return nil
 }
 
-func (router *DefaultRouter) SetRoutes(urls []string, handler func(ctx context.Context) Controller, authenticator Authenticator) {
+// Builds the url of the named route using the router serving the request.
+// Parameters are escaped, i.e. URLFor(ctx, "product.detail", map[string]string{"id": "42"}) returns "/products/42".
+// If the instance is mounted under a prefix, i.e. with http.StripPrefix("/admin", instance), the url starts with the prefix
+func URLFor(ctx context.Context, name string, params map[string]string) (string, error) {
+	r, ok := ctx.Value(keyRouter).(Router)
+	if !ok {
+		return "", ErrNamedRouteNotFound
+	}
+	url, err := r.URLFor(name, params)
+	if err != nil {
+		return "", err
+	}
+	if req, ok := ctx.Value(keyRequest).(*http.Request); ok {
+		url = strippedPrefix(req) + url
+	}
+	return url, nil
+}
+
+// Returns the template functions to build urls from named routes.
+// "urlfor" takes the route name followed by key-value pairs of parameters:
+// {{urlfor "product.detail" "id" .ID}}
+func URLFuncMap(r Router) template.FuncMap {
+	return PrefixedURLFuncMap(r, "")
+}
+
+// Returns the template functions to build urls from named routes, prepending the prefix the instance is mounted under,
+// i.e. "/admin" for an instance served by http.StripPrefix("/admin", instance). Templates don't know the request,
+// so the prefix can't be read from it as URLFor does
+func PrefixedURLFuncMap(r Router, prefix string) template.FuncMap {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return template.FuncMap{
+		"urlfor": func(name string, pairs ...interface{}) (string, error) {
+			if len(pairs)%2 != 0 {
+				return "", fmt.Errorf("urlfor %q: odd number of parameters", name)
+			}
+			params := make(map[string]string, len(pairs)/2)
+			for i := 0; i < len(pairs); i += 2 {
+				params[fmt.Sprint(pairs[i])] = fmt.Sprint(pairs[i+1])
+			}
+			url, err := r.URLFor(name, params)
+			if err != nil {
+				return "", err
+			}
+			return prefix + url, nil
+		},
+	}
+}
+
+func (router *DefaultRouter) SetRoutes(urls []string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error {
 	for _, v := range urls {
-		router.SetRoute(v, handler, authenticator)
+		if err := router.SetRoute(v, handler, authenticator, middlewares...); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func (router *DefaultRouter) SetRoute(url string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error {
+	return router.SetMethodRoute("", url, handler, authenticator, middlewares...)
 }
 
-func (router *DefaultRouter) SetRoute(url string, handler func(ctx context.Context) Controller, authenticator Authenticator) {
-	router.Router.SetRoute(url, func(ctx context.Context) (interface{}, context.Context) {
+func (router *DefaultRouter) SetMethodRoute(method string, url string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error {
+	err := router.Router.SetMethodRoute(method, url, func(ctx context.Context) (interface{}, context.Context) {
 		if authenticator != nil {
 			ctx = authenticator.Authenticate(ctx)
 		}
+		ctx = withRouteMiddlewares(ctx, middlewares)
 		return handler(ctx), ctx
 	})
+
+	if err != nil {
+		if router.Strict {
+			panic(err)
+		}
+		return err
+	}
+
+	if authenticator != nil {
+		router.authenticators[method+" "+url] = fmt.Sprintf("%T", authenticator)
+	}
+	return nil
+}
+
+func (router *DefaultRouter) Routes() []RouteInfo {
+	var infos []RouteInfo
+	for _, r := range router.Router.Routes() {
+		for _, m := range r.SetMethods() {
+			infos = append(infos, RouteInfo{
+				Pattern:       r.Pattern,
+				Method:        m,
+				Name:          r.Name,
+				Authenticator: router.authenticators[m+" "+r.Pattern],
+			})
+		}
+	}
+	return infos
+}
+
+func (router *DefaultRouter) Group(prefix string, authenticator Authenticator, middlewares ...Middleware) Router {
+	return &routeGroup{parent: router, prefix: prefix, authenticator: authenticator, middlewares: middlewares}
+}
+
+func (router *DefaultRouter) NameRoute(name string, url string) error {
+	return router.Router.NameRoute(name, url)
+}
+
+func (router *DefaultRouter) URLFor(name string, params map[string]string) (string, error) {
+	return router.Router.URL(name, params)
 }
 
-func (router *DefaultRouter) RouteForPath(ctx context.Context, path string) (context.Context, error, Controller) {
-	c, err, controller := router.Router.RouteForPath(ctx, path)
+func (router *DefaultRouter) HasRoute(path string) bool {
+	return router.Router.HasRoute(path)
+}
+
+func (router *DefaultRouter) RouteForPath(ctx context.Context, method string, path string) (context.Context, error, Controller) {
+	c, err, controller := router.Router.RouteForPath(ctx, method, path)
 	if err != nil {
 		return c, err, nil
 	}
 	return c, nil, controller.(Controller)
 }
+
+// A set of routes sharing the same prefix, authenticator and middlewares.
+// Routes are registered on the parent router with the prefix prepended to their url
+type routeGroup struct {
+	parent        Router
+	prefix        string
+	authenticator Authenticator
+	middlewares   []Middleware
+}
+
+// joins the group prefix with the url, avoiding double slashes
+func joinPath(prefix string, url string) string {
+	if strings.HasSuffix(prefix, "/") && strings.HasPrefix(url, "/") {
+		return prefix + url[1:]
+	}
+	return prefix + url
+}
+
+func (group *routeGroup) SetRoute(url string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error {
+	return group.SetMethodRoute("", url, handler, authenticator, middlewares...)
+}
+
+func (group *routeGroup) SetRoutes(urls []string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error {
+	for _, v := range urls {
+		if err := group.SetRoute(v, handler, authenticator, middlewares...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (group *routeGroup) SetMethodRoute(method string, url string, handler func(ctx context.Context) Controller, authenticator Authenticator, middlewares ...Middleware) error {
+	if authenticator == nil {
+		authenticator = group.authenticator
+	}
+	mws := append(group.middlewares[:len(group.middlewares):len(group.middlewares)], middlewares...)
+	return group.parent.SetMethodRoute(method, joinPath(group.prefix, url), handler, authenticator, mws...)
+}
+
+func (group *routeGroup) Group(prefix string, authenticator Authenticator, middlewares ...Middleware) Router {
+	return &routeGroup{parent: group, prefix: prefix, authenticator: authenticator, middlewares: middlewares}
+}
+
+func (group *routeGroup) NameRoute(name string, url string) error {
+	return group.parent.NameRoute(name, joinPath(group.prefix, url))
+}
+
+func (group *routeGroup) URLFor(name string, params map[string]string) (string, error) {
+	return group.parent.URLFor(name, params)
+}
+
+// returns the prefix of the group joined with the prefixes of the groups it is nested in
+func (group *routeGroup) fullPrefix() string {
+	if parent, ok := group.parent.(*routeGroup); ok {
+		return joinPath(parent.fullPrefix(), group.prefix)
+	}
+	return group.prefix
+}
+
+// Lists the routes of the parent router sharing the group prefix
+func (group *routeGroup) Routes() []RouteInfo {
+	var infos []RouteInfo
+	prefix := strings.TrimSuffix(group.fullPrefix(), "/")
+	for _, info := range group.parent.Routes() {
+		if info.Pattern == prefix || strings.HasPrefix(info.Pattern, prefix+"/") {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Looks up the full path, prefix included, in the parent router
+func (group *routeGroup) HasRoute(path string) bool {
+	return group.parent.HasRoute(path)
+}
+
+// Routes the full request path, prefix included, through the parent router
+func (group *routeGroup) RouteForPath(ctx context.Context, method string, path string) (context.Context, error, Controller) {
+	return group.parent.RouteForPath(ctx, method, path)
+}
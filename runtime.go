@@ -0,0 +1,54 @@
+package flamel
+
+import (
+	"context"
+	"google.golang.org/appengine"
+	"net/http"
+	"os"
+)
+
+// A Runtime abstracts the environment flamel is hosted in.
+// It supplies the base context of each request and the loop that serves them,
+// so that the same application can run on Google App Engine, on a plain server or inside unit tests.
+type Runtime interface {
+	// returns the base context for the given request
+	NewContext(req *http.Request) context.Context
+	// serves the requests using the given handler. It blocks until the server stops
+	Serve(handler http.Handler) error
+}
+
+// Runs flamel on Google App Engine
+type AppengineRuntime struct{}
+
+func (rt AppengineRuntime) NewContext(req *http.Request) context.Context {
+	return appengine.NewContext(req)
+}
+
+func (rt AppengineRuntime) Serve(handler http.Handler) error {
+	http.Handle("/", handler)
+	appengine.Main()
+	return nil
+}
+
+// Runs flamel on top of the standard library net/http server.
+// It can be used on Cloud Run, a plain VM or in tests
+type StandardRuntime struct {
+	// address to listen on. If empty, the PORT environment variable is used, defaulting to 8080
+	Addr string
+}
+
+func (rt StandardRuntime) NewContext(req *http.Request) context.Context {
+	return req.Context()
+}
+
+func (rt StandardRuntime) Serve(handler http.Handler) error {
+	addr := rt.Addr
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		addr = ":" + port
+	}
+	return http.ListenAndServe(addr, handler)
+}
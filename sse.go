@@ -0,0 +1,127 @@
+package flamel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the header sent by EventSource clients when reconnecting, as canonicalized in the RequestInputs
+const KeyLastEventID = "Last-Event-Id"
+
+// the interval between heartbeats of an SSERenderer, if not set
+const DefaultHeartbeat = 15 * time.Second
+
+// An Event is a server-sent event
+type Event struct {
+	// the id of the event. Clients send the id of the last event received when reconnecting
+	ID string
+	// the type of the event. If empty the client dispatches a "message" event
+	Event string
+	// the payload of the event. Multiline data is split on multiple data lines
+	Data string
+	// the reconnection time the client should use, if not zero
+	Retry time.Duration
+}
+
+// writes the event in the text/event-stream format.
+// Line breaks would split the ID and the type of the event into other fields, so they are rejected
+func (e Event) WriteTo(w io.Writer) (int64, error) {
+	if strings.ContainsAny(e.ID, "\r\n") {
+		return 0, errors.New("sse: the id of the event contains a line break")
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return 0, errors.New("sse: the type of the event contains a line break")
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	// CR, LF and CRLF all end a line of the stream
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteByte('\n')
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Returns the id of the last event received by the client, as sent on reconnection, or an empty string
+func LastEventID(ctx context.Context) string {
+	ins := InputsFromContext(ctx)
+	if id := ins[KeyLastEventID].Value(); id != "" {
+		return id
+	}
+	// EventSource polyfills that can't set headers send it in the query
+	return ins["lastEventId"].Value()
+}
+
+// Keeps the connection open and sends the events received from Events as server-sent events (text/event-stream).
+// A comment line is sent every Heartbeat, so that proxies don't close an idle connection.
+// The stream ends when Events is closed or when the request context is done, i.e. because the client went away:
+// producers sending on Events should select on the context as well, to avoid blocking forever.
+// A controller resumes the stream from the event following LastEventID(ctx)
+type SSERenderer struct {
+	Events <-chan Event
+	// defaults to DefaultHeartbeat. A negative value disables the heartbeats
+	Heartbeat time.Duration
+}
+
+func (renderer *SSERenderer) Render(w http.ResponseWriter) error {
+	return renderer.RenderContext(context.Background(), w)
+}
+
+func (renderer *SSERenderer) RenderContext(ctx context.Context, w http.ResponseWriter) error {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// disable the buffering of nginx based proxies
+	h.Set("X-Accel-Buffering", "no")
+
+	fw := newFlushWriter(w, 0)
+	// send the headers right away, so that the client knows the stream is open
+	fw.flush()
+
+	interval := renderer.Heartbeat
+	if interval == 0 {
+		interval = DefaultHeartbeat
+	}
+	var heartbeat <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat:
+			if _, err := io.WriteString(fw, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+		case e, ok := <-renderer.Events:
+			if !ok {
+				return nil
+			}
+			if _, err := e.WriteTo(fw); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package flamel
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the length of the fingerprint inserted in the names of the assets
+const fingerprintLen = 16
+
+// A CachePolicy returns the Cache-Control header of a static file.
+// fingerprinted is true if the file has been requested by its fingerprinted name, i.e. "main.3f2a1b9c0d4e5f60.css"
+type CachePolicy func(name string, fingerprinted bool) string
+
+// Caches fingerprinted files forever, since their name changes along with their content,
+// while any other file is revalidated on each request
+func DefaultCachePolicy(name string, fingerprinted bool) string {
+	if fingerprinted {
+		return "public, max-age=31536000, immutable"
+	}
+	return "public, no-cache"
+}
+
+// Static serves the files of a file system, i.e. os.DirFS("public") or an embed.FS, under an url prefix
+type Static struct {
+	FS fs.FS
+	// the url prefix the files are served under, i.e. "/static"
+	Prefix string
+	// the file served for directories. Defaults to "index.html"
+	Index string
+	// defaults to DefaultCachePolicy
+	CachePolicy CachePolicy
+	// the prefix the instance is mounted under, i.e. "/admin" for http.StripPrefix("/admin", instance).
+	// It is prepended to the asset paths, which are built outside of any request
+	MountPrefix string
+
+	// the prefix of the group the route has been set on, if any
+	group  string
+	mu     sync.Mutex
+	hashes map[string]staticHash
+}
+
+// the hash of the content of a file, valid as long as the file isn't modified
+type staticHash struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+func NewStatic(fsys fs.FS, prefix string) *Static {
+	return &Static{FS: fsys, Prefix: strings.TrimSuffix(prefix, "/"), hashes: make(map[string]staticHash)}
+}
+
+// Sets the GET route serving the files on the router. HEAD requests are served as well
+func (s *Static) SetRoute(router Router, authenticator Authenticator, middlewares ...Middleware) error {
+	if group, ok := router.(*routeGroup); ok {
+		s.group = strings.TrimSuffix(group.fullPrefix(), "/")
+	}
+	return router.SetMethodRoute(http.MethodGet, s.Prefix+"/*path", func(ctx context.Context) Controller {
+		return &StaticController{Static: s}
+	}, authenticator, middlewares...)
+}
+
+// returns the hash of the content of the file
+func (s *Static) hash(name string, info fs.FileInfo) (string, error) {
+	s.mu.Lock()
+	h, ok := s.hashes[name]
+	s.mu.Unlock()
+	if ok && h.modTime.Equal(info.ModTime()) && h.size == info.Size() {
+		return h.sum, nil
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sha := sha256.New()
+	if _, err := io.Copy(sha, f); err != nil {
+		return "", err
+	}
+
+	h = staticHash{modTime: info.ModTime(), size: info.Size(), sum: hex.EncodeToString(sha.Sum(nil))[:fingerprintLen]}
+	s.mu.Lock()
+	if s.hashes == nil {
+		s.hashes = make(map[string]staticHash)
+	}
+	s.hashes[name] = h
+	s.mu.Unlock()
+	return h.sum, nil
+}
+
+// inserts the fingerprint before the extension of the file: "css/main.css" becomes "css/main.<fingerprint>.css"
+func fingerprintName(name string, fingerprint string) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(name, ext), fingerprint, ext)
+}
+
+// splits a fingerprinted name into the name of the file and the fingerprint.
+// ok is false if the name is not fingerprinted
+func splitFingerprint(name string) (string, string, bool) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	i := strings.LastIndexByte(stem, '.')
+	if i == -1 || len(stem)-i-1 != fingerprintLen || strings.ContainsRune(stem[i:], '/') {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(stem[i+1:]); err != nil {
+		return "", "", false
+	}
+	return stem[:i] + ext, stem[i+1:], true
+}
+
+// Returns the url of the asset, fingerprinted with the hash of its content,
+// so that it can be cached by clients until it changes. The url includes the prefix of the group the files are served by
+// and the MountPrefix
+func (s *Static) AssetPath(name string) (string, error) {
+	name = strings.TrimPrefix(name, "/")
+	info, err := fs.Stat(s.FS, name)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("asset %q is a directory", name)
+	}
+
+	fingerprint, err := s.hash(name, info)
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.TrimSuffix(s.MountPrefix, "/") + s.group + s.Prefix
+	return prefix + "/" + fingerprintName(name, fingerprint), nil
+}
+
+// Returns the template functions related to the static files:
+// "asset" returns the fingerprinted url of a file, i.e. {{asset "css/main.css"}}
+func AssetFuncMap(s *Static) template.FuncMap {
+	return template.FuncMap{
+		"asset": s.AssetPath,
+	}
+}
+
+// resolves the requested name to a file, returning its name, its info and whether it has been requested by its fingerprinted name
+func (s *Static) resolve(name string) (string, fs.FileInfo, bool, error) {
+	if name == "" {
+		name = "."
+	}
+	name = strings.TrimSuffix(name, "/")
+	// rejects empty, absolute and dot segments, i.e. "../secrets"
+	if !fs.ValidPath(name) {
+		return "", nil, false, fs.ErrNotExist
+	}
+
+	if original, fingerprint, ok := splitFingerprint(name); ok {
+		if info, err := fs.Stat(s.FS, original); err == nil && !info.IsDir() {
+			if sum, err := s.hash(original, info); err == nil && sum == fingerprint {
+				return original, info, true, nil
+			}
+		}
+	}
+
+	info, err := fs.Stat(s.FS, name)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	if info.IsDir() {
+		index := s.Index
+		if index == "" {
+			index = "index.html"
+		}
+		name = path.Join(name, index)
+		if info, err = fs.Stat(s.FS, name); err != nil {
+			return "", nil, false, err
+		}
+		if info.IsDir() {
+			return "", nil, false, fs.ErrNotExist
+		}
+	}
+	return name, info, false, nil
+}
+
+// A StaticController serves the file matching the "path" wildcard of its route
+type StaticController struct {
+	Static *Static
+	// the file being served, closed when the controller is destroyed
+	file fs.File
+}
+
+func (controller *StaticController) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	s := controller.Static
+	name, info, fingerprinted, err := s.resolve(RoutingParams(ctx)["path"].Value())
+	if err != nil {
+		return out.RenderError(NewHTTPError(http.StatusNotFound, ""))
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return out.RenderError(NewHTTPError(http.StatusNotFound, ""))
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		// not every file system returns seekable files
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return out.RenderError(err)
+		}
+		content = bytes.NewReader(data)
+	} else {
+		controller.file = f
+	}
+
+	if sum, err := s.hash(name, info); err == nil {
+		out.SetETag(sum)
+	}
+
+	policy := s.CachePolicy
+	if policy == nil {
+		policy = DefaultCachePolicy
+	}
+	if cacheControl := policy(name, fingerprinted); cacheControl != "" {
+		out.SetHeader("Cache-Control", cacheControl)
+	}
+
+	// the type is sniffed from the content if the extension is unknown
+	out.Renderer = &FileRenderer{Mime: mime.TypeByExtension(path.Ext(name)), ModTime: info.ModTime(), Data: content}
+	return HttpResponse{Status: http.StatusOK}
+}
+
+func (controller *StaticController) OnDestroy(ctx context.Context) {
+	if controller.file != nil {
+		controller.file.Close()
+	}
+}
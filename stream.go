@@ -0,0 +1,96 @@
+package flamel
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// A flushWriter flushes the response to the client when at least interval has passed since the last flush.
+// A zero interval flushes after every write
+type flushWriter struct {
+	w         io.Writer
+	flusher   http.Flusher
+	interval  time.Duration
+	lastFlush time.Time
+	// true once something has been written
+	written bool
+}
+
+func newFlushWriter(w http.ResponseWriter, interval time.Duration) *flushWriter {
+	fw := &flushWriter{w: w, interval: interval, lastFlush: time.Now()}
+	fw.flusher, _ = w.(http.Flusher)
+	return fw
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.written = true
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if fw.interval == 0 || time.Since(fw.lastFlush) >= fw.interval {
+		fw.flush()
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) flush() {
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	fw.lastFlush = time.Now()
+}
+
+// Streams the output of Producer to the client, without buffering it, i.e. for large exports.
+// The output is flushed to the client at most every FlushInterval, and after every write if FlushInterval is zero.
+// Headers and cookies set on the ResponseOutput are sent before the first chunk.
+// Once the first chunk has been sent the status of the response can't change:
+// an error returned by Producer after that point can only interrupt the stream,
+// while an error returned before writing anything is handled as the error of any other renderer
+type StreamRenderer struct {
+	// defaults to "application/octet-stream"
+	ContentType   string
+	FlushInterval time.Duration
+	Producer      func(w io.Writer) error
+}
+
+func (renderer *StreamRenderer) Render(w http.ResponseWriter) error {
+	contentType := renderer.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	fw := newFlushWriter(w, renderer.FlushInterval)
+	err := renderer.Producer(fw)
+	// a producer failing before writing anything leaves the status unsent, so that the error can still be answered
+	if err == nil || fw.written {
+		fw.flush()
+	}
+	return err
+}
+
+// Streams JSON records as newline delimited JSON (application/x-ndjson), one record per line.
+// Producer is given the function that writes a record: it should stop and return the error if writing fails,
+// i.e. because the client went away
+type NDJSONRenderer struct {
+	FlushInterval time.Duration
+	Producer      func(write func(record interface{}) error) error
+}
+
+func (renderer *NDJSONRenderer) Render(w http.ResponseWriter) error {
+	stream := StreamRenderer{
+		ContentType:   "application/x-ndjson",
+		FlushInterval: renderer.FlushInterval,
+		Producer: func(w io.Writer) error {
+			// Encode terminates each record with a newline
+			enc := json.NewEncoder(w)
+			return renderer.Producer(enc.Encode)
+		},
+	}
+	return stream.Render(w)
+}
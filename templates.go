@@ -0,0 +1,226 @@
+package flamel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const keyTemplates = "__flamel_templates__"
+
+// Templates loads the templates of the application from a directory tree, i.e.:
+//
+//	layouts/base.html
+//	partials/product/card.html
+//	pages/products/show.html
+//
+// Templates are named after their path relative to their directory, without extension: "base", "product/card", "products/show".
+// Each page is parsed along with every layout and partial, so that it can invoke them or define the blocks of a layout,
+// and is rendered by its name
+type Templates struct {
+	FS fs.FS
+	// the directories of layouts, partials and pages. Default to "layouts", "partials" and "pages"
+	LayoutsDir  string
+	PartialsDir string
+	PagesDir    string
+	// the extension of the template files. Defaults to ".html"
+	Ext string
+	// functions shared by every template, i.e. URLFuncMap and AssetFuncMap
+	Funcs template.FuncMap
+	// re-parses the templates whenever a file changes. Meant for development, it checks the files on every lookup
+	Reload bool
+
+	mu     sync.RWMutex
+	pages  map[string]*template.Template
+	stamp  uint64
+	loaded bool
+}
+
+func NewTemplates(fsys fs.FS, funcs ...template.FuncMap) *Templates {
+	t := &Templates{FS: fsys, Funcs: make(template.FuncMap)}
+	for _, f := range funcs {
+		for name, fn := range f {
+			t.Funcs[name] = fn
+		}
+	}
+	return t
+}
+
+// Returns the templates assigned to the instance serving the request, or nil if none has been configured
+func TemplatesFromContext(ctx context.Context) *Templates {
+	t, _ := ctx.Value(keyTemplates).(*Templates)
+	return t
+}
+
+func (t *Templates) dirs() (string, string, string, string) {
+	layouts, partials, pages, ext := t.LayoutsDir, t.PartialsDir, t.PagesDir, t.Ext
+	if layouts == "" {
+		layouts = "layouts"
+	}
+	if partials == "" {
+		partials = "partials"
+	}
+	if pages == "" {
+		pages = "pages"
+	}
+	if ext == "" {
+		ext = ".html"
+	}
+	return layouts, partials, pages, ext
+}
+
+// returns the template files of the directory, by template name. A missing directory has no templates
+func (t *Templates) files(dir string, ext string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := fs.WalkDir(t.FS, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || path.Ext(p) != ext {
+			return nil
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(p, dir+"/"), ext)
+		files[name] = p
+		return nil
+	})
+	return files, err
+}
+
+// computes a stamp of the template files, changing whenever a file is added, removed or modified
+func (t *Templates) computeStamp() (uint64, error) {
+	layouts, partials, pages, ext := t.dirs()
+	h := fnv.New64a()
+	for _, dir := range []string{layouts, partials, pages} {
+		files, err := t.files(dir, ext)
+		if err != nil {
+			return 0, err
+		}
+		names := make([]string, 0, len(files))
+		for _, p := range files {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+		for _, p := range names {
+			info, err := fs.Stat(t.FS, p)
+			if err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(h, "%s %d %d\n", p, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return h.Sum64(), nil
+}
+
+// parses the files into named templates of the set
+func (t *Templates) parse(set *template.Template, files map[string]string) error {
+	for name, p := range files {
+		content, err := fs.ReadFile(t.FS, p)
+		if err != nil {
+			return err
+		}
+		if _, err := set.New(name).Parse(string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses the templates. It is invoked on the first lookup, but can be called at startup so that errors surface early
+func (t *Templates) Load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.load()
+}
+
+func (t *Templates) load() error {
+	layouts, partials, pagesDir, ext := t.dirs()
+	stamp, err := t.computeStamp()
+	if err != nil {
+		return err
+	}
+
+	base := template.New("").Funcs(t.Funcs)
+	for _, dir := range []string{layouts, partials} {
+		files, err := t.files(dir, ext)
+		if err != nil {
+			return err
+		}
+		if err := t.parse(base, files); err != nil {
+			return err
+		}
+	}
+
+	files, err := t.files(pagesDir, ext)
+	if err != nil {
+		return err
+	}
+
+	pages := make(map[string]*template.Template, len(files))
+	for name, p := range files {
+		set, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if err := t.parse(set, map[string]string{name: p}); err != nil {
+			return err
+		}
+		pages[name] = set
+	}
+
+	t.pages = pages
+	t.stamp = stamp
+	t.loaded = true
+	return nil
+}
+
+// Returns the template set of the page
+func (t *Templates) Lookup(name string) (*template.Template, error) {
+	t.mu.RLock()
+	loaded, stamp := t.loaded, t.stamp
+	page, ok := t.pages[name]
+	t.mu.RUnlock()
+
+	stale := !loaded
+	if loaded && t.Reload {
+		current, err := t.computeStamp()
+		if err != nil {
+			return nil, err
+		}
+		stale = current != stamp
+	}
+
+	if stale {
+		t.mu.Lock()
+		err := t.load()
+		page, ok = t.pages[name]
+		t.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("template %q not found", name)
+	}
+	return page, nil
+}
+
+// Sets the renderer of the output to the page, executed with data
+func (t *Templates) Render(out *ResponseOutput, name string, data interface{}) error {
+	page, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	out.Renderer = &TemplateRenderer{Template: page, TemplateName: name, Data: data}
+	return nil
+}
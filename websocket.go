@@ -0,0 +1,86 @@
+package flamel
+
+import (
+	"context"
+	"decodica.com/flamel/websocket"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+const (
+	keyRequest       = "__flamel_request__"
+	keyAllowedOrigin = "__flamel_allowed_origin__"
+)
+
+// A WebSocketHandler serves a websocket connection. The connection is closed when the handler returns
+type WebSocketHandler func(ctx context.Context, conn *websocket.Conn)
+
+// A WebSocketController upgrades the request to a websocket connection served by Handler.
+// The request is routed as any other, so it goes through the authenticator and the middlewares of its route.
+// If the CORS framework is configured the Origin of the request must be one of the allowed origins,
+// otherwise only same origin requests are accepted, unless Upgrader.CheckOrigin says differently
+type WebSocketController struct {
+	Upgrader websocket.Upgrader
+	Handler  WebSocketHandler
+}
+
+func (controller *WebSocketController) Process(ctx context.Context, out *ResponseOutput) HttpResponse {
+	out.Renderer = &webSocketRenderer{upgrader: controller.Upgrader, handler: controller.Handler}
+	return HttpResponse{Status: http.StatusSwitchingProtocols}
+}
+
+func (controller *WebSocketController) OnDestroy(ctx context.Context) {}
+
+// Returns a controller factory serving websocket connections with the handler, to be used with SetRoute
+func WebSocket(handler WebSocketHandler) func(ctx context.Context) Controller {
+	return func(ctx context.Context) Controller {
+		return &WebSocketController{Handler: handler}
+	}
+}
+
+// performs the handshake and serves the connection
+type webSocketRenderer struct {
+	upgrader websocket.Upgrader
+	handler  WebSocketHandler
+}
+
+func (renderer *webSocketRenderer) Render(w http.ResponseWriter) error {
+	return renderer.RenderContext(context.Background(), w)
+}
+
+func (renderer *webSocketRenderer) RenderContext(ctx context.Context, w http.ResponseWriter) error {
+	req, ok := ctx.Value(keyRequest).(*http.Request)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	upgrader := renderer.upgrader
+	if upgrader.CheckOrigin == nil {
+		// the origin has already been validated by the CORS framework
+		if allowed, _ := ctx.Value(keyAllowedOrigin).(string); allowed != "" {
+			upgrader.CheckOrigin = func(r *http.Request) bool {
+				return r.Header.Get("Origin") == allowed
+			}
+		}
+	}
+
+	// the headers set on the response, i.e. the cookies of the ResponseOutput, are sent along with the handshake
+	conn, err := upgrader.Upgrade(w, req, w.Header())
+	if err != nil {
+		// the client has already received the error
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("websocket handler panicked: %v\n%s", r, debug.Stack())
+			conn.CloseWithCode(websocket.CloseInternalServerError, "")
+		}
+	}()
+
+	renderer.handler(ctx, conn)
+	conn.Close()
+	return nil
+}
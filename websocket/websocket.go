@@ -0,0 +1,479 @@
+// Package websocket implements the server side of the WebSocket protocol, as defined by RFC 6455,
+// without depending on anything but the standard library
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// message types, as defined by the frame opcodes
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+const continuationFrame = 0
+
+// close codes
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseInternalServerError     = 1011
+)
+
+// the GUID concatenated to the client key to compute the accept key
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the maximum size of a message, if not set on the Upgrader
+const DefaultReadLimit = 1 << 20
+
+const maxControlPayload = 125
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrReadLimit    = errors.New("websocket: read limit exceeded")
+	ErrClosed       = errors.New("websocket: use of closed connection")
+)
+
+// A CloseError is returned by ReadMessage when the peer closes the connection
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// An Upgrader upgrades http requests to websocket connections
+type Upgrader struct {
+	// reports whether the Origin of the request is accepted.
+	// If nil, requests with an Origin whose host differs from the Host of the request are rejected
+	CheckOrigin func(req *http.Request) bool
+	// the subprotocols supported by the server, in order of preference
+	Subprotocols []string
+	// the maximum size of a message in bytes. Defaults to DefaultReadLimit
+	ReadLimit int64
+}
+
+// reports whether the comma separated list of tokens of the header contains the token, case insensitively
+func headerContains(h http.Header, key string, token string) bool {
+	for _, v := range h[key] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// Returns the accept key of the handshake for the given client key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// responds to a failed handshake and returns the error
+func handshakeError(w http.ResponseWriter, status int, reason string) error {
+	http.Error(w, http.StatusText(status), status)
+	return fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+// replaces line breaks in header values, as net/http does, so that a value can't add headers to the response
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// reports whether the header is set by the handshake itself, or can't be sent along with a 101 response
+func handshakeHeader(key string) bool {
+	switch http.CanonicalHeaderKey(key) {
+	case "Upgrade", "Connection", "Sec-Websocket-Accept", "Sec-Websocket-Protocol", "Content-Length", "Transfer-Encoding":
+		return true
+	}
+	return false
+}
+
+// Upgrades the request to a websocket connection, sending header along with the response of the handshake,
+// i.e. to set cookies. The headers of the handshake itself are ignored.
+// If the handshake fails, Upgrade responds with an http error and returns an error wrapping ErrBadHandshake
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request, header http.Header) (*Conn, error) {
+	if req.Method != http.MethodGet {
+		return nil, handshakeError(w, http.StatusMethodNotAllowed, "method is not GET")
+	}
+
+	if !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") {
+		return nil, handshakeError(w, http.StatusBadRequest, "not a websocket upgrade request")
+	}
+
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, handshakeError(w, http.StatusUpgradeRequired, "unsupported version")
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, handshakeError(w, http.StatusForbidden, "origin not allowed")
+	}
+
+	key := req.Header.Get("Sec-Websocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, handshakeError(w, http.StatusBadRequest, "invalid key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, handshakeError(w, http.StatusInternalServerError, "the response writer doesn't support hijacking")
+	}
+
+	subprotocol := u.selectSubprotocol(req)
+
+	netConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Accept: %s\r\n", AcceptKey(key))
+	if subprotocol != "" {
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", subprotocol)
+	}
+	for k, values := range header {
+		if handshakeHeader(k) {
+			continue
+		}
+		for _, v := range values {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, headerValueReplacer.Replace(v))
+		}
+	}
+	b.WriteString("\r\n")
+
+	if _, err := io.WriteString(netConn, b.String()); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	limit := u.ReadLimit
+	if limit <= 0 {
+		limit = DefaultReadLimit
+	}
+	return &Conn{conn: netConn, br: brw.Reader, readLimit: limit, subprotocol: subprotocol}, nil
+}
+
+func (u *Upgrader) selectSubprotocol(req *http.Request) string {
+	for _, supported := range u.Subprotocols {
+		if headerContains(req.Header, "Sec-Websocket-Protocol", supported) {
+			return supported
+		}
+	}
+	return ""
+}
+
+// A Conn is a websocket connection.
+// A Conn supports one concurrent reader and several concurrent writers
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	readLimit   int64
+	subprotocol string
+	pongHandler func(data []byte) error
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// Returns the subprotocol negotiated during the handshake
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Sets the function invoked when a pong is received, i.e. to extend the read deadline
+func (c *Conn) SetPongHandler(handler func(data []byte) error) {
+	c.pongHandler = handler
+}
+
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+func isControl(opcode int) bool {
+	return opcode >= CloseMessage
+}
+
+// reads a frame sent by the client, whose frames are always masked
+func (c *Conn) readFrame() (frame, error) {
+	var f frame
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return f, err
+	}
+
+	f.fin = head[0]&0x80 != 0
+	f.opcode = int(head[0] & 0x0f)
+	if head[0]&0x70 != 0 {
+		return f, c.fail(CloseProtocolError, "reserved bits set")
+	}
+
+	switch f.opcode {
+	case continuationFrame, TextMessage, BinaryMessage, CloseMessage, PingMessage, PongMessage:
+	default:
+		return f, c.fail(CloseProtocolError, "unknown opcode")
+	}
+
+	if head[1]&0x80 == 0 {
+		return f, c.fail(CloseProtocolError, "client frame not masked")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, c.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+
+	if isControl(f.opcode) && (length > maxControlPayload || !f.fin) {
+		return f, c.fail(CloseProtocolError, "invalid control frame")
+	}
+
+	if length > uint64(c.readLimit) {
+		c.fail(CloseMessageTooBig, "")
+		return f, ErrReadLimit
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return f, err
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// sends a close frame with the code and closes the connection, returning an error describing the failure
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.conn.Close()
+	return &CloseError{Code: code, Text: reason}
+}
+
+// Reads the next data message, returning its type and payload.
+// Pings are answered automatically. When the client closes the connection the close is acknowledged
+// and a *CloseError holding the code sent by the client is returned
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.pongHandler != nil {
+				if err := c.pongHandler(f.payload); err != nil {
+					return 0, nil, err
+				}
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = f.opcode
+		}
+
+		if int64(len(message)+len(f.payload)) > c.readLimit {
+			c.fail(CloseMessageTooBig, "")
+			return 0, nil, ErrReadLimit
+		}
+		message = append(message, f.payload...)
+
+		if !f.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidFramePayloadData, "invalid utf-8")
+		}
+		return messageType, message, nil
+	}
+}
+
+// acknowledges the close sent by the client and returns the corresponding error
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !utf8.ValidString(closeErr.Text) {
+			return c.fail(CloseProtocolError, "invalid close reason")
+		}
+	}
+
+	code := closeErr.Code
+	if code == CloseNoStatusReceived {
+		code = CloseNormalClosure
+	}
+	c.writeClose(code, "")
+	c.conn.Close()
+	return closeErr
+}
+
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writes an unmasked frame, as servers do
+func (c *Conn) writeFrameLocked(opcode int, payload []byte) error {
+	if c.closeSent {
+		return ErrClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(opcode)
+	switch length := len(payload); {
+	case length <= maxControlPayload:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	// a single write, so that the frame is not split in several packets
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(CloseMessage, payload)
+}
+
+// Sends a message of the given type, TextMessage or BinaryMessage
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// Sends a ping. The client answers with a pong, handled by the pong handler
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: control payload too long")
+	}
+	return c.writeFrame(PingMessage, data)
+}
+
+// Sends a close frame with the given code and reason, then closes the connection
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	c.writeClose(code, reason)
+	return c.conn.Close()
+}
+
+// Closes the connection with a normal closure
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormalClosure, "")
+}
@@ -0,0 +1,173 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a minimal client, sending masked frames as browsers do
+type clientTest struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialTest(t *testing.T, url string, header http.Header) (*clientTest, *http.Response) {
+	addr := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &clientTest{conn: conn, br: br}, res
+}
+
+func (c *clientTest) writeFrame(fin bool, opcode int, payload []byte) {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+func (c *clientTest) readFrame(t *testing.T) (int, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	io.ReadFull(c.br, payload)
+	return int(head[0] & 0x0f), payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example of RFC 6455, section 1.3
+	if key := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %s", key)
+	}
+}
+
+func TestConn(t *testing.T) {
+	closed := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upgrader := Upgrader{Subprotocols: []string{"chat"}, ReadLimit: 256}
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			conn.WriteMessage(messageType, message)
+		}
+	}))
+	defer server.Close()
+
+	client, res := dialTest(t, server.URL, http.Header{"Sec-Websocket-Protocol": {"json, chat"}})
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("received status %d", res.StatusCode)
+	}
+	if p := res.Header.Get("Sec-WebSocket-Protocol"); p != "chat" {
+		t.Fatalf("negotiated subprotocol %q", p)
+	}
+
+	// fragmented text message, interleaved with a ping
+	client.writeFrame(false, TextMessage, []byte("hello "))
+	client.writeFrame(true, PingMessage, []byte("ping"))
+	client.writeFrame(true, continuationFrame, []byte("world"))
+
+	if opcode, payload := client.readFrame(t); opcode != PongMessage || string(payload) != "ping" {
+		t.Fatalf("expected pong, received %d %q", opcode, payload)
+	}
+	if opcode, payload := client.readFrame(t); opcode != TextMessage || string(payload) != "hello world" {
+		t.Fatalf("expected echo, received %d %q", opcode, payload)
+	}
+
+	client.writeFrame(true, CloseMessage, []byte{0x03, 0xe9, 'b', 'y', 'e'})
+	if opcode, payload := client.readFrame(t); opcode != CloseMessage || binary.BigEndian.Uint16(payload) != CloseGoingAway {
+		t.Fatalf("expected close acknowledgement, received %d %v", opcode, payload)
+	}
+
+	var closeErr *CloseError
+	if err := <-closed; !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway || closeErr.Text != "bye" {
+		t.Fatalf("unexpected close error %v", err)
+	}
+
+	// messages over the read limit close the connection
+	client, _ = dialTest(t, server.URL, nil)
+	client.writeFrame(true, BinaryMessage, make([]byte, 100))
+	client.writeFrame(false, BinaryMessage, make([]byte, 100))
+	client.writeFrame(false, continuationFrame, make([]byte, 100))
+	client.writeFrame(true, continuationFrame, make([]byte, 100))
+	client.readFrame(t)
+	if opcode, payload := client.readFrame(t); opcode != CloseMessage || binary.BigEndian.Uint16(payload) != CloseMessageTooBig {
+		t.Fatalf("expected close for message too big, received %d %v", opcode, payload)
+	}
+	if err := <-closed; err != ErrReadLimit {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUpgrade_Rejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upgrader := Upgrader{}
+		upgrader.Upgrade(w, req, nil)
+	}))
+	defer server.Close()
+
+	requests := []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{http.Header{"Origin": {fmt.Sprintf("http://%s", strings.TrimPrefix(server.URL, "http://"))}}, http.StatusSwitchingProtocols},
+		{http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusUpgradeRequired},
+		{http.Header{"Sec-Websocket-Key": {"short"}}, http.StatusBadRequest},
+	}
+
+	for _, r := range requests {
+		_, res := dialTest(t, server.URL, r.header)
+		if res.StatusCode != r.status {
+			t.Fatalf("%v: received status %d instead of %d", r.header, res.StatusCode, r.status)
+		}
+	}
+}